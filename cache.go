@@ -0,0 +1,333 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/OneManMonkeySquad/transport-cli/data_hives"
+)
+
+// chunkCache is a local, content-addressed cache of data hive files. Data hive file names are
+// content hashes or entry IDs, so cached files never become stale. Manifests are kept forever,
+// chunks are evicted least recently used first once the cache exceeds maxSize.
+type chunkCache struct {
+	path    string
+	maxSize int64
+
+	mutex sync.Mutex
+	size  int64 // Total size of evictable files, -1 if unknown
+	// Chunks a running restore still needs, never evicted
+	pinned map[string]struct{}
+}
+
+func newChunkCache(path string, maxSize int64) (*chunkCache, error) {
+	for _, dir := range []string{"blobs", "tags"} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	return &chunkCache{
+		path:    path,
+		maxSize: maxSize,
+		size:    -1,
+		pinned:  make(map[string]struct{}),
+	}, nil
+}
+
+func defaultCachePath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "transport-cli"), nil
+}
+
+func (c *chunkCache) blobPath(fileName string) string {
+	return filepath.Join(c.path, "blobs", fileName)
+}
+
+func isManifest(fileName string) bool {
+	return strings.HasSuffix(fileName, ".json")
+}
+
+// Get copies the cached file into w. Returns false if the file is not cached.
+func (c *chunkCache) Get(fileName string, w io.Writer) (bool, error) {
+	filePath := c.blobPath(fileName)
+
+	file, err := os.Open(filePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Mark as recently used
+	now := time.Now()
+	os.Chtimes(filePath, now, now)
+
+	_, err = io.Copy(w, file)
+	return true, err
+}
+
+// Put stores a file by letting fill write it. Incomplete files never end up in the cache.
+func (c *chunkCache) Put(fileName string, fill func(w io.Writer) error) error {
+	filePath := c.blobPath(fileName)
+
+	file, err := os.CreateTemp(filepath.Dir(filePath), fileName+".*.part")
+	if err != nil {
+		return err
+	}
+	partPath := file.Name()
+	defer os.Remove(partPath)
+	defer file.Close()
+
+	if err = fill(file); err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	if err = os.Rename(partPath, filePath); err != nil {
+		return err
+	}
+
+	if isManifest(fileName) {
+		return nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.pinned[fileName]; ok {
+		return nil
+	}
+
+	if c.size >= 0 {
+		c.size += info.Size()
+	}
+	return c.evict()
+}
+
+// Pin keeps the chunks in the cache until Unpin, even if the cache grows beyond maxSize. Restore
+// pins everything it prefetched, otherwise restores bigger than the cache download twice.
+func (c *chunkCache) Pin(fileNames []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, fileName := range fileNames {
+		c.pinned[fileName] = struct{}{}
+	}
+	c.size = -1
+}
+
+// Unpin releases all pinned chunks and shrinks the cache to maxSize again.
+func (c *chunkCache) Unpin() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.pinned = make(map[string]struct{})
+	c.size = -1
+	return c.evict()
+}
+
+// evict deletes least recently used chunks until the cache fits into maxSize.
+func (c *chunkCache) evict() error {
+	if c.size >= 0 && c.size <= c.maxSize {
+		return nil
+	}
+
+	type cachedFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	var files []cachedFile
+	var size int64
+	err := filepath.WalkDir(filepath.Join(c.path, "blobs"), func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || isManifest(d.Name()) || strings.HasSuffix(d.Name(), ".part") {
+			return nil
+		}
+		if _, ok := c.pinned[d.Name()]; ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		files = append(files, cachedFile{
+			path:    filePath,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	for _, file := range files {
+		if size <= c.maxSize {
+			break
+		}
+
+		if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		size -= file.size
+	}
+
+	c.size = size
+	return nil
+}
+
+func (c *chunkCache) tagPath(tagName string) string {
+	return filepath.Join(c.path, "tags", url.PathEscape(tagName)+".json")
+}
+
+// RememberRestoreChain stores the restore chain of a tag for offline restores.
+func (c *chunkCache) RememberRestoreChain(tagName string, restoreChain []uuid.UUID) error {
+	return writeToJsonFile(restoreChain, c.tagPath(tagName))
+}
+
+// RestoreChain returns the restore chain of the tag as seen by the last online restore.
+func (c *chunkCache) RestoreChain(tagName string) ([]uuid.UUID, error) {
+	content, err := os.ReadFile(c.tagPath(tagName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("tag '%v' is not cached (offline)", tagName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var restoreChain []uuid.UUID
+	if err = json.Unmarshal(content, &restoreChain); err != nil {
+		return nil, err
+	}
+	return restoreChain, nil
+}
+
+// cachedDataHive serves downloads from the cache and fills it. Without remote (offline) only
+// cached files are available.
+type cachedDataHive struct {
+	remote DataHive
+	cache  *chunkCache
+}
+
+func (p *cachedDataHive) Close() {
+	if p.remote != nil {
+		p.remote.Close()
+	}
+}
+
+func (p *cachedDataHive) UploadFile(fileName string, r io.Reader) error {
+	if p.remote == nil {
+		return errors.New("offline")
+	}
+	return p.remote.UploadFile(fileName, r)
+}
+
+func (p *cachedDataHive) Stat(fileName string) (*data_hives.FileInfo, error) {
+	if p.remote != nil {
+		return p.remote.Stat(fileName)
+	}
+
+	info, err := os.Stat(p.cache.blobPath(fileName))
+	if err != nil {
+		return nil, err
+	}
+
+	return &data_hives.FileInfo{
+		Name:    fileName,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (p *cachedDataHive) List(prefix string) ([]data_hives.FileInfo, error) {
+	if p.remote == nil {
+		return nil, errors.New("offline")
+	}
+	return p.remote.List(prefix)
+}
+
+func (p *cachedDataHive) Delete(fileName string) error {
+	if p.remote == nil {
+		return errors.New("offline")
+	}
+
+	os.Remove(p.cache.blobPath(fileName))
+	return p.remote.Delete(fileName)
+}
+
+func (p *cachedDataHive) Touch(fileName string) error {
+	if p.remote == nil {
+		return errors.New("offline")
+	}
+	return p.remote.Touch(fileName)
+}
+
+// Evict removes a corrupt file from the cache.
+func (p *cachedDataHive) Evict(fileName string) bool {
+	err := os.Remove(p.cache.blobPath(fileName))
+	if err == nil {
+		fmt.Printf("Evicted corrupt %v from the cache\n", fileName)
+	}
+	return err == nil && p.remote != nil
+}
+
+func (p *cachedDataHive) DownloadFile(fileName string, w io.Writer) error {
+	cached, err := p.cache.Get(fileName, w)
+	if err != nil || cached {
+		return err
+	}
+
+	if p.remote == nil {
+		return fmt.Errorf("%v is not cached (offline)", fileName)
+	}
+
+	err = p.cache.Put(fileName, func(cacheWriter io.Writer) error {
+		return p.remote.DownloadFile(fileName, cacheWriter)
+	})
+	if err != nil {
+		return err
+	}
+
+	cached, err = p.cache.Get(fileName, w)
+	if err == nil && !cached {
+		err = fmt.Errorf("%v evicted from cache right away, cache too small", fileName)
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io"
+	"math/bits"
+	"sync"
+)
+
+// Content-defined chunking (FastCDC). Chunk boundaries depend on the content only, so
+// inserting or removing bytes changes the chunks around the edit but not the rest of the file.
+
+// gearTable must never change, otherwise chunk boundaries (and with them all hashes) change.
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+
+	// splitmix64
+	state := uint64(0x5472616e73706f72)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Chunk sizes of content-defined chunking. Small enough that edits only change little data,
+// big enough to keep the number of files in the data hive and the manifests small.
+const (
+	chunkAvgSize = 1024 * 1024
+	chunkMaxSize = 8 * 1024 * 1024
+)
+
+// Chunkers reuse their buffers, only one per file staged concurrently exists
+var chunkerBuffers = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, chunkMaxSize)
+		return &buf
+	},
+}
+
+type chunker struct {
+	r          io.Reader
+	pooledBuf  *[]byte
+	buf        []byte
+	start, end int
+	eof        bool
+
+	minSize, avgSize, maxSize int
+	// Normalized chunking: harder to cut before avgSize, easier after
+	maskS, maskL uint64
+}
+
+// newChunker creates a chunker producing chunks of at most limit bytes. Limits above chunkMaxSize
+// don't change the chunks.
+func newChunker(r io.Reader, limit int) *chunker {
+	maxSize := chunkMaxSize
+	if limit < maxSize {
+		maxSize = limit
+	}
+	avgSize := chunkAvgSize
+	if maxSize/4 < avgSize {
+		avgSize = maxSize / 4
+	}
+	avgBits := bits.Len(uint(avgSize)) - 1
+
+	pooledBuf := chunkerBuffers.Get().(*[]byte)
+	return &chunker{
+		r:         r,
+		pooledBuf: pooledBuf,
+		buf:       (*pooledBuf)[:maxSize],
+		minSize:   avgSize / 4,
+		avgSize:   avgSize,
+		maxSize:   maxSize,
+		maskS:     ^uint64(0) << (64 - (avgBits + 2)),
+		maskL:     ^uint64(0) << (64 - (avgBits - 2)),
+	}
+}
+
+// Next returns the next chunk or io.EOF. The chunk is only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if c.end-c.start < c.maxSize && !c.eof {
+		n := copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+		c.end = n
+
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	n := c.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
+
+// Close returns the buffer to the pool, chunks returned by Next are invalid afterwards.
+func (c *chunker) Close() {
+	chunkerBuffers.Put(c.pooledBuf)
+	c.pooledBuf = nil
+	c.buf = nil
+}
+
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.minSize {
+		return n
+	}
+	if n > c.maxSize {
+		n = c.maxSize
+	}
+
+	normal := c.avgSize
+	if n < normal {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.minSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
@@ -4,9 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/OneManMonkeySquad/transport-cli/meta_hives"
 )
 
 func commit(cfg *Config, tagName string) error {
@@ -20,16 +25,45 @@ func commit(cfg *Config, tagName string) error {
 	var dataFiles []string
 	{
 		patch := readPatchFile(filePath)
+		if cfg.signingKey != nil {
+			if err := signPatchFile(&patch, cfg.signingKey); err != nil {
+				return err
+			}
+			if err := writeToJsonFile(patch, filePath); err != nil {
+				return err
+			}
+		}
+
 		newEntryID = patch.ID
 		newBaseID = patch.BaseID
-		for _, entry := range patch.Changed {
-			for i := 0; i < entry.AdditionalChunks+1; i += 1 {
-				name := entry.Hash
-				if i > 0 {
-					name = fmt.Sprintf("%s_%d", name, i)
+		// Chunks that weren't staged are already in the data hive
+		dataFileSet := make(map[string]struct{})
+		addDataFiles := func(ref blobRef) error {
+			for _, name := range ref.ChunkNames() {
+				if _, ok := dataFileSet[name]; ok {
+					continue
 				}
 
-				dataFiles = append(dataFiles, name)
+				staged, err := exists(".staging/" + name)
+				if err != nil {
+					return err
+				}
+				if staged {
+					dataFileSet[name] = struct{}{}
+					dataFiles = append(dataFiles, name)
+				}
+			}
+			return nil
+		}
+
+		for _, entry := range patch.Changed {
+			if err := addDataFiles(entry.Blob()); err != nil {
+				return err
+			}
+			if entry.Delta != nil {
+				if err := addDataFiles(entry.DeltaBlob()); err != nil {
+					return err
+				}
 			}
 		}
 	}
@@ -45,36 +79,78 @@ func commit(cfg *Config, tagName string) error {
 		}
 	}
 
-	// Upload datas
-	for _, dataFile := range dataFiles {
-		data, err := os.ReadFile(".staging/" + dataFile)
+	// Upload datas. Uploads are recorded in the journal so a failed commit can be resumed.
+	journal, err := openUploadJournal(".staging/journal")
+	if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	uploadProgress := newProgress("Uploading", len(dataFiles))
+	err = forEachParallel(cfg.parallelism, len(dataFiles), func(i int) error {
+		dataFile := dataFiles[i]
+
+		if journal.Contains(dataFile) {
+			uploadProgress.Skip(dataFile, "uploaded before")
+			return nil
+		}
+
+		modTime, err := presentModTime(cfg.dataHive, dataFile, ".staging/"+dataFile)
 		if err != nil {
-			return err
+			return fmt.Errorf("stat %v: %v", dataFile, err)
 		}
 
-		fmt.Println("Uploading", dataFile, "...")
-		if err = cfg.dataHive.UploadFile(dataFile, data); err != nil {
-			return err
+		if !modTime.IsZero() {
+			uploadProgress.Skip(dataFile, "already present")
+		} else {
+			uploadProgress.Step(dataFile)
+			if err := uploadFile(cfg.dataHive, dataFile, ".staging/"+dataFile); err != nil {
+				return fmt.Errorf("upload %v: %v", dataFile, err)
+			}
+			modTime = time.Now()
 		}
+
+		return journal.Add(dataFile, modTime)
+	})
+	if err != nil {
+		return err
 	}
 
 	// Upload patch
-	{
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			return err
-		}
+	if err := uploadFile(cfg.dataHive, newEntryID.String()+".json", filePath); err != nil {
+		return err
+	}
 
-		err = cfg.dataHive.UploadFile(newEntryID.String()+".json", data)
+	// Patches must be published on top of their base. A new version replaces whatever the tag
+	// points at right now.
+	expectedHead := newBaseID
+	if newBaseID == uuid.Nil {
+		tag, err := cfg.metaHive.FindTagByName(tagName)
 		if err != nil {
 			return err
 		}
+		if tag != nil {
+			expectedHead = tag.Id
+		}
 	}
 
-	cfg.metaHive.UpdateTag(tagName, newEntryID)
-	cfg.metaHive.AddEntry(newEntryID, newBaseID)
+	err = cfg.metaHive.Publish(newEntryID, newBaseID, tagName, expectedHead)
+	if errors.Is(err, meta_hives.ErrTagConflict) {
+		return fmt.Errorf("%w, the tag was published to since the patch was created, create the patch again", err)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Keep restore chains short. The entry is published already, a failed squash must not fail
+	// the commit, the next commit tries again.
+	if err := autoSquash(cfg, tagName, newEntryID); err != nil {
+		fmt.Printf("Warning: squash failed, restore chain of '%v' stays long: %v\n", tagName, err)
+	}
 
 	// Remove patch
+	journal.Close()
+	os.Remove(".staging/journal")
 	os.Remove(filePath)
 	for _, dataFile := range dataFiles {
 		os.Remove(".staging/" + dataFile)
@@ -82,3 +158,114 @@ func commit(cfg *Config, tagName string) error {
 
 	return nil
 }
+
+// Files already in the data hive which are older than this are touched before they are reused,
+// they might be unreferenced and deleted by gc any moment otherwise. The grace period of gc has
+// to be longer, then nothing a commit in progress relies on is deleted.
+const maxUntouchedAge = time.Hour
+
+// presentModTime returns the modification time of the file in the data hive, if it has it already
+// with the same size as the local one. Old files are touched first. Returns the zero time if the
+// file has to be uploaded.
+func presentModTime(dataHive DataHive, fileName string, filePath string) (time.Time, error) {
+	remoteInfo, err := dataHive.Stat(fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	localInfo, err := os.Stat(filePath)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if remoteInfo.Size != localInfo.Size() {
+		return time.Time{}, nil
+	}
+	if touched(remoteInfo.ModTime) {
+		return remoteInfo.ModTime, nil
+	}
+
+	if err := dataHive.Touch(fileName); err != nil {
+		fmt.Printf("%v: touch failed, uploading it again (%v)\n", fileName, err)
+		return time.Time{}, nil
+	}
+	return time.Now(), nil
+}
+
+// touched returns whether a file was written or touched recently enough that gc keeps it.
+func touched(modTime time.Time) bool {
+	return time.Since(modTime) < maxUntouchedAge
+}
+
+// uploadJournal is an append-only list of uploaded files with the time the data hive got them.
+type uploadJournal struct {
+	mutex    sync.Mutex
+	file     *os.File
+	uploaded map[string]time.Time
+}
+
+func openUploadJournal(path string) (*uploadJournal, error) {
+	journal := &uploadJournal{
+		uploaded: make(map[string]time.Time),
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			// Journals without times are too old to trust
+			continue
+		}
+
+		unixTime, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		journal.uploaded[fields[0]] = time.Unix(unixTime, 0)
+	}
+
+	journal.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return journal, nil
+}
+
+// Contains returns whether the file was uploaded recently enough to be reused without checking.
+func (j *uploadJournal) Contains(fileName string) bool {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	modTime, ok := j.uploaded[fileName]
+	return ok && touched(modTime)
+}
+
+func (j *uploadJournal) Add(fileName string, modTime time.Time) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.uploaded[fileName] = modTime
+	_, err := fmt.Fprintf(j.file, "%v %d\n", fileName, modTime.Unix())
+	return err
+}
+
+func (j *uploadJournal) Close() {
+	j.file.Close()
+}
+
+func uploadFile(dataHive DataHive, fileName string, filePath string) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return dataHive.UploadFile(fileName, file)
+}
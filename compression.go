@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	codecZstd = "zstd"
+	codecZlib = "zlib"
+	codecNone = "none"
+)
+
+var (
+	zstdEncodersMutex sync.Mutex
+	zstdEncoders      = make(map[int]*zstd.Encoder)
+
+	// Streaming decoders, they hold buffers of about one chunk
+	zstdDecoders sync.Pool
+)
+
+func validCodec(codec string) bool {
+	return codec == codecZstd || codec == codecZlib || codec == codecNone
+}
+
+// entryCodec returns the codec of an entry. Entries without codec were written when zlib was the only one.
+func entryCodec(codec string) string {
+	if codec == "" {
+		return codecZlib
+	}
+	return codec
+}
+
+// codecExtension returns the suffix of stored chunks.
+func codecExtension(codec string) string {
+	switch codec {
+	case codecZstd:
+		return ".zst"
+	case codecNone:
+		return ".raw"
+	default:
+		return ".zlib"
+	}
+}
+
+// compress compresses content with the given codec. Level 0 is the codec's default level.
+func compress(codec string, level int, content []byte) (*bytes.Buffer, error) {
+	compressedContent := new(bytes.Buffer)
+
+	switch codec {
+	case codecZstd:
+		encoder, err := getZstdEncoder(level)
+		if err != nil {
+			return nil, err
+		}
+
+		compressedContent.Write(encoder.EncodeAll(content, nil))
+
+	case codecZlib:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+
+		zlibWriter, err := zlib.NewWriterLevel(compressedContent, level)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := zlibWriter.Write(content); err != nil {
+			return nil, err
+		}
+		if err := zlibWriter.Close(); err != nil {
+			return nil, err
+		}
+
+	case codecNone:
+		compressedContent.Write(content)
+
+	default:
+		return nil, fmt.Errorf("unknown codec '%v'", codec)
+	}
+
+	return compressedContent, nil
+}
+
+func decompress(codec string, w io.Writer, compressedContent io.Reader) error {
+	switch codec {
+	case codecZstd:
+		decoder, err := getZstdDecoder()
+		if err != nil {
+			return err
+		}
+
+		if err := decoder.Reset(compressedContent); err != nil {
+			return err
+		}
+		_, err = io.Copy(w, decoder)
+
+		decoder.Reset(nil)
+		zstdDecoders.Put(decoder)
+		return err
+
+	case codecZlib:
+		zlibReader, err := zlib.NewReader(compressedContent)
+		if err != nil {
+			return err
+		}
+		defer zlibReader.Close()
+
+		_, err = io.Copy(w, zlibReader)
+		if err != nil && err != io.ErrUnexpectedEOF { // Blobs staged by older versions lack the zlib trailer
+			return err
+		}
+		return nil
+
+	case codecNone:
+		_, err := io.Copy(w, compressedContent)
+		return err
+
+	default:
+		return fmt.Errorf("unknown codec '%v'", codec)
+	}
+}
+
+// compressedSizeOf streams content through the codec and returns the compressed size.
+func compressedSizeOf(codec string, level int, content io.Reader) (int64, error) {
+	counter := &countingWriter{}
+
+	switch codec {
+	case codecZstd:
+		encoderLevel := zstd.SpeedDefault
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+
+		zstdWriter, err := zstd.NewWriter(counter, zstd.WithEncoderLevel(encoderLevel))
+		if err != nil {
+			return 0, err
+		}
+		if _, err = io.Copy(zstdWriter, content); err != nil {
+			zstdWriter.Close()
+			return 0, err
+		}
+		if err = zstdWriter.Close(); err != nil {
+			return 0, err
+		}
+
+	case codecZlib:
+		if level == 0 {
+			level = zlib.DefaultCompression
+		}
+
+		zlibWriter, err := zlib.NewWriterLevel(counter, level)
+		if err != nil {
+			return 0, err
+		}
+		if _, err = io.Copy(zlibWriter, content); err != nil {
+			return 0, err
+		}
+		if err = zlibWriter.Close(); err != nil {
+			return 0, err
+		}
+
+	case codecNone:
+		if _, err := io.Copy(counter, content); err != nil {
+			return 0, err
+		}
+
+	default:
+		return 0, fmt.Errorf("unknown codec '%v'", codec)
+	}
+
+	return counter.n, nil
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+func getZstdEncoder(level int) (*zstd.Encoder, error) {
+	zstdEncodersMutex.Lock()
+	defer zstdEncodersMutex.Unlock()
+
+	if encoder, ok := zstdEncoders[level]; ok {
+		return encoder, nil
+	}
+
+	encoderLevel := zstd.SpeedDefault
+	if level != 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+	if err != nil {
+		return nil, err
+	}
+
+	zstdEncoders[level] = encoder
+	return encoder, nil
+}
+
+// getZstdDecoder returns a decoder of the pool, put it back when done.
+func getZstdDecoder() (*zstd.Decoder, error) {
+	if decoder, ok := zstdDecoders.Get().(*zstd.Decoder); ok {
+		return decoder, nil
+	}
+	return zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+}
@@ -1,8 +1,15 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/pelletier/go-toml"
 	"golang.org/x/crypto/ssh"
@@ -15,6 +22,24 @@ type Config struct {
 	dataHive    DataHive
 	metaHive    MetaHive
 	chunkSizeMb int
+	codec       string
+	codecLevel  int
+	// Number of concurrent uploads/downloads
+	parallelism int
+	// Optional local cache of downloaded files
+	cache *chunkCache
+	// Only the cache is available
+	offline bool
+	// Commit squashes the tag after this many patches, 0 disables squashing
+	squashEvery int
+	// Signs published manifests, optional
+	signingKey ed25519.PrivateKey
+	// Manifests must be signed by this key, optional
+	publicKey ed25519.PublicKey
+	// Record modification times in manifests
+	preserveMtime bool
+	// Paths restore never touches, gitignore syntax
+	protected *ignoreRules
 }
 
 func NewConfig(metaHive MetaHive, dataHive DataHive) *Config {
@@ -22,6 +47,9 @@ func NewConfig(metaHive MetaHive, dataHive DataHive) *Config {
 		dataHive:    dataHive,
 		metaHive:    metaHive,
 		chunkSizeMb: 50,
+		codec:       codecZstd,
+		parallelism: 4,
+		protected:   &ignoreRules{},
 	}
 }
 
@@ -30,12 +58,256 @@ func (cfg *Config) ChunkSize() int {
 }
 
 func readConfig(name string) (*Config, error) {
+	return loadConfig(name, false, true)
+}
+
+// readOfflineConfig reads the configuration without connecting to any hive, only the cache is used.
+func readOfflineConfig(name string) (*Config, error) {
+	return loadConfig(name, true, true)
+}
+
+// readUncachedConfig reads the configuration with the cache disabled, everything is read from the hives.
+func readUncachedConfig(name string) (*Config, error) {
+	return loadConfig(name, false, false)
+}
+
+func loadConfig(name string, offline bool, useCache bool) (*Config, error) {
 	cfg, err := toml.LoadFile(name)
 	if err != nil {
 		return nil, err
 	}
 
-	chunkSize := (int)(cfg.Get("chunk_size_mb").(int64))
+	chunkSize := (int)(cfg.GetDefault("chunk_size_mb", int64(50)).(int64))
+	if chunkSize < 1 {
+		return nil, errors.New("chunk_size_mb must be at least 1")
+	}
+
+	codec := cfg.GetDefault("compression", codecZstd).(string)
+	if !validCodec(codec) {
+		return nil, errors.New("unknown compression '" + codec + "'")
+	}
+	codecLevel := (int)(cfg.GetDefault("compression_level", int64(0)).(int64))
+
+	parallelism := (int)(cfg.GetDefault("parallelism", int64(4)).(int64))
+	if parallelism < 1 {
+		return nil, errors.New("parallelism must be at least 1")
+	}
+
+	squashEvery := (int)(cfg.GetDefault("squash_every", int64(0)).(int64))
+	if squashEvery < 0 {
+		return nil, errors.New("squash_every must not be negative")
+	}
+
+	preserveMtime := cfg.GetDefault("preserve_mtime", false).(bool)
+
+	protected, err := readProtected(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	signingKey, publicKey, err := readKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var cache *chunkCache
+	if useCache {
+		cache, err = readCache(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	encryption, err := readEncryption(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var config *Config
+	if offline {
+		if cache == nil {
+			return nil, errors.New("offline mode requires the cache")
+		}
+
+		config = NewConfig(nil, &cachedDataHive{cache: cache})
+		config.offline = true
+	} else {
+		dataHive, err := readDataHive(cfg, parallelism)
+		if err != nil {
+			return nil, err
+		}
+
+		metaHive, err := readMetaHive(cfg)
+		if err != nil {
+			dataHive.Close()
+			return nil, err
+		}
+
+		if cache != nil {
+			dataHive = &cachedDataHive{remote: dataHive, cache: cache}
+		}
+		config = NewConfig(metaHive, dataHive)
+	}
+
+	config.chunkSizeMb = chunkSize
+	config.codec = codec
+	config.codecLevel = codecLevel
+	config.parallelism = parallelism
+	if encryption != nil {
+		config.dataHive = &encryptedDataHive{inner: config.dataHive, keys: encryption}
+	}
+
+	config.cache = cache
+	config.squashEvery = squashEvery
+	config.signingKey = signingKey
+	config.publicKey = publicKey
+	config.preserveMtime = preserveMtime
+	config.protected = protected
+	return config, nil
+}
+
+// readKeys reads the signing key from TRANSPORT_SIGNING_KEY or signing_key_file and the public
+// key from public_key.
+func readKeys(cfg *toml.Tree) (ed25519.PrivateKey, ed25519.PublicKey, error) {
+	var signingKey ed25519.PrivateKey
+	var publicKey ed25519.PublicKey
+	var err error
+
+	signingKeyStr := os.Getenv("TRANSPORT_SIGNING_KEY")
+	if keyFile := cfg.GetDefault("signing_key_file", "").(string); signingKeyStr == "" && keyFile != "" {
+		content, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		signingKeyStr = string(content)
+	}
+	if signingKeyStr != "" {
+		signingKey, err = parsePrivateKey(signingKeyStr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if publicKeyStr := cfg.GetDefault("public_key", "").(string); publicKeyStr != "" {
+		publicKey, err = parsePublicKey(publicKeyStr)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return signingKey, publicKey, nil
+}
+
+// readEncryption reads the encryption keys from [encryption] or TRANSPORT_ENCRYPTION_KEYS
+// ("id=key,id=key") and the ID of the key for new files from key_id or TRANSPORT_ENCRYPTION_KEY_ID.
+// Returns nil if no key is configured.
+func readEncryption(cfg *toml.Tree) (*encryptionKeys, error) {
+	keys := make(map[string]string)
+	if keysTree, ok := cfg.Get("encryption.keys").(*toml.Tree); ok {
+		for keyID, key := range keysTree.ToMap() {
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("encryption key '%v' must be a string", keyID)
+			}
+			keys[keyID] = keyStr
+		}
+	}
+	if envKeys := os.Getenv("TRANSPORT_ENCRYPTION_KEYS"); envKeys != "" {
+		for _, pair := range strings.Split(envKeys, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("TRANSPORT_ENCRYPTION_KEYS must be a list of id=key")
+			}
+			keys[strings.TrimSpace(parts[0])] = parts[1]
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	keyID := cfg.GetDefault("encryption.key_id", "").(string)
+	if envKeyID := os.Getenv("TRANSPORT_ENCRYPTION_KEY_ID"); envKeyID != "" {
+		keyID = envKeyID
+	}
+
+	encryption, err := parseEncryptionKeys(keyID, keys)
+	if err != nil {
+		return nil, err
+	}
+	encryption.allowUnencrypted = cfg.GetDefault("encryption.allow_unencrypted", false).(bool)
+	return encryption, nil
+}
+
+// readProtected reads the paths restore must never touch from [restore] protected.
+func readProtected(cfg *toml.Tree) (*ignoreRules, error) {
+	var patterns []string
+	for _, pattern := range cfg.GetDefault("restore.protected", []interface{}{}).([]interface{}) {
+		patternStr, ok := pattern.(string)
+		if !ok {
+			return nil, errors.New("restore.protected must be a list of strings")
+		}
+		patterns = append(patterns, patternStr)
+	}
+
+	rules, err := newIgnoreRules(patterns, nil)
+	if err != nil {
+		return nil, fmt.Errorf("restore.protected: %v", err)
+	}
+	return rules, nil
+}
+
+func readCache(cfg *toml.Tree) (*chunkCache, error) {
+	if !cfg.GetDefault("cache.enabled", true).(bool) {
+		return nil, nil
+	}
+
+	path := cfg.GetDefault("cache.path", "").(string)
+	if path == "" {
+		var err error
+		path, err = defaultCachePath()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxSizeMb := cfg.GetDefault("cache.max_size_mb", int64(2048)).(int64)
+
+	// Configurations of different hives share the cache directory, but not the cached tags
+	return newChunkCache(filepath.Join(path, hiveIdentity(cfg)), maxSizeMb*1024*1024)
+}
+
+// hiveIdentity names the data and meta hive of the configuration by type and location.
+func hiveIdentity(cfg *toml.Tree) string {
+	locationKeys := map[string][]string{
+		"sftp":   {"sftp.host", "sftp.subfolder"},
+		"local":  {"local.path"},
+		"http":   {"http.host"},
+		"php":    {"php.address"},
+		"sqlite": {"sqlite.file_name"},
+		"server": {"server.address"},
+	}
+
+	identity := sha256.New()
+	for _, key := range []string{"data_hive", "meta_hive"} {
+		hiveType := strings.ToLower(cfg.GetDefault(key, "").(string))
+		fmt.Fprintf(identity, "%v=%v\n", key, hiveType)
+
+		for _, locationKey := range locationKeys[hiveType] {
+			location := fmt.Sprint(cfg.GetDefault(locationKey, ""))
+			if locationKey == "local.path" || locationKey == "sqlite.file_name" {
+				if absPath, err := filepath.Abs(location); err == nil {
+					location = absPath
+				}
+			}
+			fmt.Fprintf(identity, "%v=%v\n", locationKey, location)
+		}
+	}
+	return hex.EncodeToString(identity.Sum(nil))[:16]
+}
+
+func readDataHive(cfg *toml.Tree, parallelism int) (DataHive, error) {
+	var err error
 
 	dataHiveType := cfg.Get("data_hive").(string)
 
@@ -52,7 +324,8 @@ func readConfig(name string) (*Config, error) {
 		}
 		sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
 
-		dataHive, err = data_hives.NewSFTP(host, subfolder, sshConfig)
+		// One connection per worker
+		dataHive, err = data_hives.NewSFTP(host, subfolder, sshConfig, parallelism)
 		if err != nil {
 			return nil, err
 		}
@@ -63,7 +336,24 @@ func readConfig(name string) (*Config, error) {
 	} else if strings.EqualFold(dataHiveType, "http") {
 		host := cfg.Get("http.host").(string)
 
-		dataHive = data_hives.NewHTTP(host)
+		options := data_hives.HTTPOptions{
+			Timeout:    time.Duration(cfg.GetDefault("http.timeout_seconds", int64(30)).(int64)) * time.Second,
+			Retries:    (int)(cfg.GetDefault("http.retries", int64(3)).(int64)),
+			RetryDelay: time.Second,
+			Proxy:      cfg.GetDefault("http.proxy", "").(string),
+			Token:      cfg.GetDefault("http.token", "").(string),
+			Headers:    make(map[string]string),
+		}
+		if headers, ok := cfg.Get("http.headers").(*toml.Tree); ok {
+			for key, value := range headers.ToMap() {
+				options.Headers[key] = fmt.Sprint(value)
+			}
+		}
+
+		dataHive, err = data_hives.NewHTTP(host, options)
+		if err != nil {
+			return nil, err
+		}
 	} else if strings.EqualFold(dataHiveType, "s3") {
 		// #todo
 		dataHive, err = data_hives.NewS3("...", "...", "...", "...", "...")
@@ -74,6 +364,12 @@ func readConfig(name string) (*Config, error) {
 		return nil, errors.New("unknown data_hive '" + dataHiveType + "'")
 	}
 
+	return dataHive, nil
+}
+
+func readMetaHive(cfg *toml.Tree) (MetaHive, error) {
+	var err error
+
 	metaHiveType := cfg.Get("meta_hive").(string)
 
 	var metaHive MetaHive
@@ -91,11 +387,18 @@ func readConfig(name string) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
+	} else if strings.EqualFold(metaHiveType, "server") {
+		address := cfg.Get("server.address").(string)
+		token := cfg.GetDefault("server.token", "").(string)
+		timeout := time.Duration(cfg.GetDefault("server.timeout_seconds", int64(30)).(int64)) * time.Second
+
+		metaHive, err = meta_hives.NewHttp(address, token, timeout)
+		if err != nil {
+			return nil, err
+		}
 	} else {
 		return nil, errors.New("unknown meta_hive '" + metaHiveType + "'")
 	}
 
-	config := NewConfig(metaHive, dataHive)
-	config.chunkSizeMb = chunkSize
-	return config, nil
+	return metaHive, nil
 }
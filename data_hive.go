@@ -1,7 +1,47 @@
 package main
 
+import (
+	"errors"
+	"io"
+
+	"github.com/OneManMonkeySquad/transport-cli/data_hives"
+)
+
 type DataHive interface {
-	UploadFile(fileName string, data []byte) error
-	DownloadFile(fileName string) ([]byte, error)
+	UploadFile(fileName string, r io.Reader) error
+	DownloadFile(fileName string, w io.Writer) error
+	// Stat returns an error matching os.ErrNotExist if the file doesn't exist
+	Stat(fileName string) (*data_hives.FileInfo, error)
+	// List returns all files whose name starts with prefix
+	List(prefix string) ([]data_hives.FileInfo, error)
+	Delete(fileName string) error
+	// Touch sets the modification time of the file to now, gc keeps files younger than its grace period
+	Touch(fileName string) error
 	Close()
 }
+
+// errCorruptContent is returned for downloads whose content doesn't match its hash or authentication.
+var errCorruptContent = errors.New("corrupt content")
+
+// cacheEvictor is implemented by data hives caching downloads.
+type cacheEvictor interface {
+	// Evict removes a file from the cache. Returns whether downloading it again reaches the remote.
+	Evict(fileName string) bool
+}
+
+// evictCorrupt removes corrupt files from the cache of the data hive. Returns whether downloading
+// them again might help.
+func evictCorrupt(backend DataHive, fileNames ...string) bool {
+	evictor, ok := backend.(cacheEvictor)
+	if !ok {
+		return false
+	}
+
+	retry := false
+	for _, fileName := range fileNames {
+		if evictor.Evict(fileName) {
+			retry = true
+		}
+	}
+	return retry
+}
@@ -1,17 +1,20 @@
 package data_hives
 
 import (
-	"bytes"
-	"io/ioutil"
+	"errors"
+	"io"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 type s3Persistence struct {
 	s3Client *s3.S3
+	uploader *s3manager.Uploader
 	bucket   string
 }
 
@@ -31,6 +34,7 @@ func NewS3(key string, secret string, endpoint string, region string, bucket str
 
 	return &s3Persistence{
 		s3Client: s3Client,
+		uploader: s3manager.NewUploaderWithClient(s3Client),
 		bucket:   bucket,
 	}, nil
 }
@@ -38,15 +42,15 @@ func NewS3(key string, secret string, endpoint string, region string, bucket str
 func (p *s3Persistence) Close() {
 }
 
-func (p *s3Persistence) UploadFile(fileName string, data []byte) error {
-	object := s3.PutObjectInput{
+func (p *s3Persistence) UploadFile(fileName string, r io.Reader) error {
+	object := s3manager.UploadInput{
 		Bucket: aws.String(p.bucket),      // The path to the directory you want to upload the object to, starting with your Space name.
 		Key:    aws.String(fileName),      // Object key, referenced whenever you want to access this file later.
-		Body:   bytes.NewReader(data),     // The object's contents.
+		Body:   r,                         // The object's contents, uploaded in parts if big.
 		ACL:    aws.String("public-read"), // Defines Access-control List (ACL) permissions, such as private or public.
 	}
 
-	_, err := p.s3Client.PutObject(&object)
+	_, err := p.uploader.Upload(&object)
 	if err != nil {
 		return err
 	}
@@ -54,21 +58,97 @@ func (p *s3Persistence) UploadFile(fileName string, data []byte) error {
 	return nil
 }
 
-func (p *s3Persistence) DownloadFile(fileName string) ([]byte, error) {
-	input := &s3.GetObjectInput{
+func (p *s3Persistence) Stat(fileName string) (*FileInfo, error) {
+	input := &s3.HeadObjectInput{
 		Bucket: aws.String(p.bucket),
 		Key:    aws.String(fileName),
 	}
 
-	result, err := p.s3Client.GetObject(input)
+	result, err := p.s3Client.HeadObject(input)
 	if err != nil {
-		return nil, err
+		return nil, s3Error(fileName, err)
+	}
+
+	return &FileInfo{
+		Name:    fileName,
+		Size:    aws.Int64Value(result.ContentLength),
+		ModTime: aws.TimeValue(result.LastModified),
+	}, nil
+}
+
+func (p *s3Persistence) List(prefix string) ([]FileInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(p.bucket),
+		Prefix: aws.String(prefix),
 	}
 
-	body, err := ioutil.ReadAll(result.Body)
+	var result []FileInfo
+	err := p.s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			result = append(result, FileInfo{
+				Name:    aws.StringValue(object.Key),
+				Size:    aws.Int64Value(object.Size),
+				ModTime: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return body, nil
+	return result, nil
+}
+
+func (p *s3Persistence) Delete(fileName string) error {
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(fileName),
+	}
+
+	_, err := p.s3Client.DeleteObject(input)
+	return err
+}
+
+// Touch copies the object onto itself, which is the only way to change its modification time.
+func (p *s3Persistence) Touch(fileName string) error {
+	input := &s3.CopyObjectInput{
+		Bucket:            aws.String(p.bucket),
+		Key:               aws.String(fileName),
+		CopySource:        aws.String(p.bucket + "/" + fileName),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace), // Copying onto itself requires a change
+		ACL:               aws.String("public-read"),
+	}
+
+	_, err := p.s3Client.CopyObject(input)
+	if err != nil {
+		return s3Error(fileName, err)
+	}
+	return nil
+}
+
+func (p *s3Persistence) DownloadFile(fileName string, w io.Writer) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(p.bucket),
+		Key:    aws.String(fileName),
+	}
+
+	result, err := p.s3Client.GetObject(input)
+	if err != nil {
+		return s3Error(fileName, err)
+	}
+	defer result.Body.Close()
+
+	_, err = io.Copy(w, result.Body)
+	return err
+}
+
+// s3Error turns missing objects into NotFoundError. HEAD requests have no body and report
+// "NotFound", GET requests "NoSuchKey".
+func s3Error(fileName string, err error) error {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && (awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey) {
+		return &NotFoundError{Name: fileName}
+	}
+	return err
 }
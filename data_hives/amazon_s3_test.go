@@ -0,0 +1,23 @@
+package data_hives
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestS3NotFound(t *testing.T) {
+	for _, code := range []string{"NotFound", "NoSuchKey"} {
+		err := s3Error("chunk", awserr.New(code, "missing", nil))
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%v: expected os.ErrNotExist, got %v", code, err)
+		}
+	}
+
+	err := s3Error("chunk", awserr.New("AccessDenied", "denied", nil))
+	if errors.Is(err, os.ErrNotExist) {
+		t.Error("AccessDenied reported as missing")
+	}
+}
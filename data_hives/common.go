@@ -0,0 +1,28 @@
+package data_hives
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+var ErrReadOnly = errors.New("data hive is read-only")
+
+// NotFoundError is returned if a file doesn't exist in the data hive. It matches os.ErrNotExist.
+type NotFoundError struct {
+	Name string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Name + ": not found"
+}
+
+func (e *NotFoundError) Unwrap() error {
+	return os.ErrNotExist
+}
+
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
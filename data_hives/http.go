@@ -1,46 +1,245 @@
 package data_hives
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
+	"time"
 )
 
+type HTTPOptions struct {
+	// Timeout for connecting and for the response headers, 0 means no timeout. Bodies can take
+	// as long as they need.
+	Timeout time.Duration
+	// Number of retries of failed requests, each one waiting twice as long as the one before
+	Retries    int
+	RetryDelay time.Duration
+	// Proxy URL, empty means the proxy from the environment (HTTP_PROXY, HTTPS_PROXY, NO_PROXY)
+	Proxy string
+	// Sent with every request. A token is sent as bearer token.
+	Headers map[string]string
+	Token   string
+}
+
 type httpPersistence struct {
-	host string
+	host    string
+	client  *http.Client
+	options HTTPOptions
 }
 
-func NewHTTP(host string) *httpPersistence {
+func NewHTTP(host string, options HTTPOptions) (*httpPersistence, error) {
 	if !strings.HasSuffix(host, "/") {
 		host += "/"
 	}
 
-	return &httpPersistence{
-		host: host,
+	proxy := http.ProxyFromEnvironment
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+		proxy = http.ProxyURL(proxyURL)
 	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   options.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout:   options.Timeout,
+		ResponseHeaderTimeout: options.Timeout,
+		IdleConnTimeout:       90 * time.Second,
+		MaxIdleConnsPerHost:   16,
+	}
+
+	return &httpPersistence{
+		host:    host,
+		client:  &http.Client{Transport: transport},
+		options: options,
+	}, nil
 }
 
 func (p *httpPersistence) Close() {
+	p.client.CloseIdleConnections()
+}
+
+func (p *httpPersistence) UploadFile(fileName string, r io.Reader) error {
+	return ErrReadOnly
+}
+
+func (p *httpPersistence) List(prefix string) ([]FileInfo, error) {
+	return nil, ErrReadOnly
+}
+
+func (p *httpPersistence) Delete(fileName string) error {
+	return ErrReadOnly
+}
+
+func (p *httpPersistence) Touch(fileName string) error {
+	return ErrReadOnly
 }
 
-func (p *httpPersistence) UploadFile(fileName string, data []byte) error {
-	return errors.New("http backend is read-only")
+func (p *httpPersistence) Stat(fileName string) (*FileInfo, error) {
+	var info *FileInfo
+	err := p.retry(func() (bool, error) {
+		resp, err := p.request(http.MethodHead, fileName, nil)
+		if err != nil {
+			return true, err
+		}
+		defer resp.Body.Close()
+
+		if err := checkStatus(fileName, resp); err != nil {
+			return retryable(resp.StatusCode), err
+		}
+
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		info = &FileInfo{
+			Name:    fileName,
+			Size:    resp.ContentLength,
+			ModTime: modTime,
+		}
+		return false, nil
+	})
+	return info, err
 }
 
-func (p *httpPersistence) DownloadFile(fileName string) ([]byte, error) {
-	resp, err := http.Get(p.host + fileName)
+// DownloadFile downloads the file into w. Interrupted downloads continue where they stopped.
+func (p *httpPersistence) DownloadFile(fileName string, w io.Writer) error {
+	var written int64
+	// ETag or modification time the continuation has to match
+	var validator string
+
+	return p.retry(func() (bool, error) {
+		header := make(http.Header)
+		if written > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", written))
+			if validator != "" {
+				header.Set("If-Range", validator)
+			}
+		}
+
+		resp, err := p.request(http.MethodGet, fileName, header)
+		if err != nil {
+			return true, err
+		}
+		defer resp.Body.Close()
+
+		if err := checkStatus(fileName, resp); err != nil {
+			return retryable(resp.StatusCode), err
+		}
+
+		body := io.Reader(resp.Body)
+		if written > 0 && resp.StatusCode != http.StatusPartialContent {
+			if validator != "" {
+				// If-Range failed, the file changed since the first part was written
+				return false, fmt.Errorf("%v: changed on the server during the download", fileName)
+			}
+
+			// Server ignored the range, skip what we have already
+			if _, err := io.CopyN(io.Discard, body, written); err != nil {
+				return true, err
+			}
+		}
+		if resp.StatusCode == http.StatusOK {
+			validator = resp.Header.Get("ETag")
+			if strings.HasPrefix(validator, "W/") {
+				validator = "" // Weak ETags can't be used for ranges
+			}
+			if resp.Uncompressed {
+				// The ETag names the compressed response, the continuation is a range of the
+				// uncompressed file
+				validator = resp.Header.Get("Last-Modified")
+			}
+		}
+
+		n, err := io.Copy(&destinationWriter{w: w}, body)
+		written += n
+		if err != nil {
+			var writeErr *writerError
+			if errors.As(err, &writeErr) {
+				return false, writeErr.err
+			}
+			if resp.Uncompressed && validator == "" && written > 0 {
+				return false, fmt.Errorf("%v: compressed download interrupted, can't continue it without modification time: %v", fileName, err)
+			}
+			return true, err
+		}
+
+		return false, nil
+	})
+}
+
+// destinationWriter tells write errors apart from read errors, only the latter are retried.
+type destinationWriter struct {
+	w io.Writer
+}
+
+type writerError struct {
+	err error
+}
+
+func (e *writerError) Error() string {
+	return e.err.Error()
+}
+
+func (w *destinationWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
 	if err != nil {
-		return nil, err
+		return n, &writerError{err: err}
 	}
-	defer resp.Body.Close()
+	return n, nil
+}
 
-	buf := bytes.NewBuffer(nil)
-	_, err = io.Copy(buf, resp.Body)
+func (p *httpPersistence) request(method string, fileName string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, p.host+url.PathEscape(fileName), nil)
 	if err != nil {
 		return nil, err
 	}
 
-	return buf.Bytes(), nil
+	for key, value := range p.options.Headers {
+		req.Header.Set(key, value)
+	}
+	if p.options.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.options.Token)
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	return p.client.Do(req)
+}
+
+// retry calls fn until it succeeds, fails with a permanent error or no retries are left.
+func (p *httpPersistence) retry(fn func() (bool, error)) error {
+	delay := p.options.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retry, err := fn()
+		if err == nil || !retry || attempt >= p.options.Retries {
+			return err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func checkStatus(fileName string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+		return nil
+	case http.StatusNotFound, http.StatusGone:
+		return &NotFoundError{Name: fileName}
+	default:
+		return fmt.Errorf("%v: %v", fileName, resp.Status)
+	}
+}
+
+// retryable reports whether a request failing with the status code might succeed later.
+func retryable(statusCode int) bool {
+	return statusCode >= 500 || statusCode == http.StatusRequestTimeout || statusCode == http.StatusTooManyRequests
 }
@@ -0,0 +1,264 @@
+package data_hives
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves dir and injects failures.
+type flakyServer struct {
+	files http.Handler
+
+	mutex sync.Mutex
+	// Number of requests answered with 503
+	failures int
+	// Number of downloads aborted after half the content
+	truncations int
+	// Optional, called after a download was aborted
+	truncated func()
+	requests  []*http.Request
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.requests = append(s.requests, r)
+	fail := s.failures > 0
+	if fail {
+		s.failures--
+	}
+	truncate := !fail && s.truncations > 0 && r.Method == http.MethodGet
+	if truncate {
+		s.truncations--
+	}
+	s.mutex.Unlock()
+
+	if fail {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	if truncate {
+		recorder := httptest.NewRecorder()
+		s.files.ServeHTTP(recorder, r)
+
+		for key, values := range recorder.Header() {
+			w.Header()[key] = values
+		}
+		body := recorder.Body.Bytes()
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(recorder.Code)
+		w.Write(body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		if s.truncated != nil {
+			s.truncated()
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	s.files.ServeHTTP(w, r)
+}
+
+func newFlakyServer(t *testing.T, content []byte) (*flakyServer, *httptest.Server) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "blob.zst"), content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky := &flakyServer{files: NewDataServer(dir, nil)}
+	server := httptest.NewServer(flaky)
+	t.Cleanup(server.Close)
+	return flaky, server
+}
+
+func testContent() []byte {
+	content := make([]byte, 256*1024)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content
+}
+
+func newTestHTTP(t *testing.T, url string, options HTTPOptions) *httpPersistence {
+	options.Timeout = 5 * time.Second
+	options.RetryDelay = time.Millisecond
+
+	hive, err := NewHTTP(url, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(hive.Close)
+	return hive
+}
+
+func TestHTTPRetries(t *testing.T) {
+	content := testContent()
+	flaky, server := newFlakyServer(t, content)
+	hive := newTestHTTP(t, server.URL, HTTPOptions{Retries: 3})
+
+	flaky.failures = 3
+	downloaded := new(bytes.Buffer)
+	if err := hive.DownloadFile("blob.zst", downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Error("content differs")
+	}
+
+	flaky.failures = 4
+	err := hive.DownloadFile("blob.zst", new(bytes.Buffer))
+	if err == nil {
+		t.Error("expected download to fail after all retries")
+	}
+
+	flaky.failures = 2
+	info, err := hive.Stat("blob.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(content)) {
+		t.Errorf("unexpected size %v", info.Size)
+	}
+}
+
+func TestHTTPResume(t *testing.T) {
+	content := testContent()
+	flaky, server := newFlakyServer(t, content)
+	hive := newTestHTTP(t, server.URL, HTTPOptions{Retries: 3})
+
+	flaky.truncations = 1
+	downloaded := new(bytes.Buffer)
+	if err := hive.DownloadFile("blob.zst", downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatal("content differs")
+	}
+
+	if len(flaky.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %v", len(flaky.requests))
+	}
+	expectedRange := "bytes=" + strconv.Itoa(len(content)/2) + "-"
+	if resume := flaky.requests[1]; resume.Header.Get("Range") != expectedRange || resume.Header.Get("If-Range") == "" {
+		t.Errorf("expected resume with range %v, got %v (If-Range %v)", expectedRange, resume.Header.Get("Range"), resume.Header.Get("If-Range"))
+	}
+}
+
+func TestHTTPResumeCompressed(t *testing.T) {
+	content := testContent()
+	flaky, server := newFlakyServer(t, content)
+	hive := newTestHTTP(t, server.URL, HTTPOptions{Retries: 3})
+
+	// Manifests are sent gzip compressed, continuations are ranges of the uncompressed file
+	dir := flaky.files.(*DataServer).path
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	flaky.truncations = 1
+	downloaded := new(bytes.Buffer)
+	if err := hive.DownloadFile("manifest.json", downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Fatal("content differs")
+	}
+
+	if len(flaky.requests) != 2 {
+		t.Fatalf("expected 2 requests, got %v", len(flaky.requests))
+	}
+	ifRange := flaky.requests[1].Header.Get("If-Range")
+	if _, err := http.ParseTime(ifRange); err != nil || flaky.requests[1].Header.Get("Range") == "" {
+		t.Errorf("expected resume by modification time, got range %v (If-Range %v)", flaky.requests[1].Header.Get("Range"), ifRange)
+	}
+}
+
+func TestHTTPResumeChanged(t *testing.T) {
+	content := testContent()
+	flaky, server := newFlakyServer(t, content)
+	hive := newTestHTTP(t, server.URL, HTTPOptions{Retries: 3})
+
+	// Uploaded again in between, f.i. with a new encryption key
+	dir := flaky.files.(*DataServer).path
+	flaky.truncations = 1
+	flaky.truncated = func() {
+		os.WriteFile(filepath.Join(dir, "blob.zst"), append([]byte("new "), content...), 0666)
+	}
+
+	err := hive.DownloadFile("blob.zst", new(bytes.Buffer))
+	if err == nil {
+		t.Fatal("expected download of changed file to fail")
+	}
+
+	// Not retried
+	if len(flaky.requests) != 2 {
+		t.Errorf("expected 2 requests, got %v", len(flaky.requests))
+	}
+}
+
+func TestHTTPNotFound(t *testing.T) {
+	flaky, server := newFlakyServer(t, testContent())
+	hive := newTestHTTP(t, server.URL, HTTPOptions{Retries: 3})
+
+	err := hive.DownloadFile("missing.zst", new(bytes.Buffer))
+	var notFound *NotFoundError
+	if !errors.As(err, &notFound) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	_, err = hive.Stat("missing.zst")
+	if !errors.As(err, &notFound) {
+		t.Errorf("expected not found error, got %v", err)
+	}
+
+	// Not found is final
+	if len(flaky.requests) != 2 {
+		t.Errorf("expected no retries, got %v requests", len(flaky.requests))
+	}
+}
+
+func TestHTTPHeaders(t *testing.T) {
+	flaky, server := newFlakyServer(t, testContent())
+	hive := newTestHTTP(t, server.URL, HTTPOptions{
+		Token:   "secret",
+		Headers: map[string]string{"X-Client": "transport"},
+	})
+
+	if err := hive.DownloadFile("blob.zst", new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+
+	req := flaky.requests[0]
+	if req.Header.Get("Authorization") != "Bearer secret" {
+		t.Errorf("unexpected authorization %q", req.Header.Get("Authorization"))
+	}
+	if req.Header.Get("X-Client") != "transport" {
+		t.Errorf("unexpected header %q", req.Header.Get("X-Client"))
+	}
+}
+
+func TestHTTPProxy(t *testing.T) {
+	// The proxy receives the request for the data hive
+	content := testContent()
+	proxy, server := newFlakyServer(t, content)
+
+	hive := newTestHTTP(t, "http://hive.invalid/", HTTPOptions{Proxy: server.URL})
+
+	downloaded := new(bytes.Buffer)
+	if err := hive.DownloadFile("blob.zst", downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded.Bytes(), content) {
+		t.Error("content differs")
+	}
+	if proxy.requests[0].Host != "hive.invalid" {
+		t.Errorf("request not sent through proxy: %v", proxy.requests[0].Host)
+	}
+}
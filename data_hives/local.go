@@ -1,8 +1,11 @@
 package data_hives
 
 import (
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
 type localPersistence struct {
@@ -18,12 +21,86 @@ func NewLocal(path string) *localPersistence {
 func (p *localPersistence) Close() {
 }
 
-func (p *localPersistence) UploadFile(fileName string, data []byte) error {
+func (p *localPersistence) UploadFile(fileName string, r io.Reader) error {
 	filePath := filepath.Join(p.path, fileName)
-	return os.WriteFile(filePath, data, 0644)
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
 }
 
-func (p *localPersistence) DownloadFile(fileName string) ([]byte, error) {
+func (p *localPersistence) Stat(fileName string) (*FileInfo, error) {
 	filePath := filepath.Join(p.path, fileName)
-	return os.ReadFile(filePath)
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		Name:    fileName,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (p *localPersistence) List(prefix string) ([]FileInfo, error) {
+	files, err := os.ReadDir(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []FileInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+
+		info, err := file.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		result = append(result, FileInfo{
+			Name:    file.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	return result, nil
+}
+
+func (p *localPersistence) Delete(fileName string) error {
+	filePath := filepath.Join(p.path, fileName)
+	return os.Remove(filePath)
+}
+
+func (p *localPersistence) Touch(fileName string) error {
+	filePath := filepath.Join(p.path, fileName)
+
+	now := time.Now()
+	return os.Chtimes(filePath, now, now)
+}
+
+func (p *localPersistence) DownloadFile(fileName string, w io.Writer) error {
+	filePath := filepath.Join(p.path, fileName)
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
 }
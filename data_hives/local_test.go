@@ -0,0 +1,86 @@
+package data_hives
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	dir := t.TempDir()
+	p := NewLocal(dir)
+	defer p.Close()
+
+	for _, name := range []string{"abc.raw", "abd.raw", "other.json"} {
+		if err := p.UploadFile(name, strings.NewReader(name+" content")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Directories aren't files of the hive
+	if err := os.Mkdir(filepath.Join(dir, "abx"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := p.Stat("abc.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "abc.raw" || info.Size != int64(len("abc.raw content")) {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	files, err := p.List("ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if strings.Join(names, ",") != "abc.raw,abd.raw" {
+		t.Errorf("unexpected list %v", names)
+	}
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dir, "abc.raw"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Touch("abc.raw"); err != nil {
+		t.Fatal(err)
+	}
+	info, err = p.Stat("abc.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime.After(old) {
+		t.Errorf("modification time %v not updated", info.ModTime)
+	}
+
+	if err := p.Delete("abc.raw"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.Stat("abc.raw"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist from Stat, got %v", err)
+	}
+	if err := p.DownloadFile("abc.raw", new(bytes.Buffer)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist from DownloadFile, got %v", err)
+	}
+	if err := p.Delete("abc.raw"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist from Delete, got %v", err)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := p.DownloadFile("abd.raw", buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "abd.raw content" {
+		t.Errorf("unexpected content '%v'", buf.String())
+	}
+}
@@ -0,0 +1,211 @@
+package data_hives
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DataServer serves a local data hive directory for the http data hive. Files in a data hive are
+// never modified once written (names are content hashes or entry IDs), so they can be cached
+// forever by clients and proxies.
+type DataServer struct {
+	path      string
+	accessLog io.Writer
+
+	mutex sync.Mutex
+	etags map[string]etagEntry
+}
+
+type etagEntry struct {
+	size    int64
+	modTime time.Time
+	etag    string
+}
+
+// NewDataServer serves the files in path. Every request is logged to accessLog if not nil.
+func NewDataServer(path string, accessLog io.Writer) *DataServer {
+	return &DataServer{
+		path:      path,
+		accessLog: accessLog,
+		etags:     make(map[string]etagEntry),
+	}
+}
+
+func (s *DataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+	s.serve(lw, r)
+
+	if s.accessLog != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		fmt.Fprintf(s.accessLog, "%s [%s] \"%s %s %s\" %d %d %v\n", host, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method, r.URL.RequestURI(), r.Proto, lw.status, lw.written, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+func (s *DataServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Data hives are flat, nothing outside of path or hidden is served
+	fileName := strings.TrimPrefix(r.URL.Path, "/")
+	if fileName == "" || strings.ContainsAny(fileName, "/\\") || strings.HasPrefix(fileName, ".") {
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(s.path, fileName))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag, err := s.etag(fileName, file, info)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+
+	header := w.Header()
+	header.Set("Cache-Control", "public, max-age=31536000, immutable")
+	header.Set("Vary", "Accept-Encoding")
+	if strings.HasSuffix(fileName, ".json") {
+		header.Set("Content-Type", "application/json")
+	} else {
+		header.Set("Content-Type", "application/octet-stream")
+	}
+
+	// Manifests compress well, chunks are compressed already. Ranges always refer to the
+	// uncompressed file.
+	if strings.HasSuffix(fileName, ".json") && r.Method == http.MethodGet && r.Header.Get("Range") == "" && acceptsGzip(r) {
+		s.serveGzip(w, r, file, info, etag)
+		return
+	}
+
+	header.Set("ETag", etag)
+	http.ServeContent(w, r, fileName, info.ModTime(), file)
+}
+
+func (s *DataServer) serveGzip(w http.ResponseWriter, r *http.Request, file *os.File, info os.FileInfo, etag string) {
+	// Different representation, different strong ETag
+	gzipEtag := strings.TrimSuffix(etag, `"`) + `-gzip"`
+
+	header := w.Header()
+	header.Set("ETag", gzipEtag)
+	header.Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+
+	if etagMatches(r.Header.Get("If-None-Match"), gzipEtag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	w.WriteHeader(http.StatusOK)
+
+	gzipWriter := gzip.NewWriter(w)
+	io.Copy(gzipWriter, file)
+	gzipWriter.Close()
+}
+
+// etag returns the strong ETag of the file, the hash of its content. Hashes are remembered
+// until size or modification time change.
+func (s *DataServer) etag(fileName string, file *os.File, info os.FileInfo) (string, error) {
+	s.mutex.Lock()
+	entry, ok := s.etags[fileName]
+	s.mutex.Unlock()
+
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		return entry.etag, nil
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+
+	s.mutex.Lock()
+	s.etags[fileName] = etagEntry{
+		size:    info.Size(),
+		modTime: info.ModTime(),
+		etag:    etag,
+	}
+	s.mutex.Unlock()
+
+	return etag, nil
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(encoding, ";")
+		if strings.TrimSpace(parts[0]) != "gzip" {
+			continue
+		}
+
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag || candidate == "W/"+etag {
+			return true
+		}
+	}
+	return false
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,178 @@
+package data_hives
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestDataServer(t *testing.T, files map[string]string) (*httptest.Server, *bytes.Buffer) {
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accessLog := new(bytes.Buffer)
+	server := httptest.NewServer(NewDataServer(dir, accessLog))
+	t.Cleanup(server.Close)
+	return server, accessLog
+}
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	// No transparent decompression
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestDataServerWithHttpHive(t *testing.T) {
+	server, accessLog := newTestDataServer(t, map[string]string{
+		"blob.zst": "blob content",
+	})
+
+	hive, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hive.Close()
+
+	content := new(bytes.Buffer)
+	if err := hive.DownloadFile("blob.zst", content); err != nil {
+		t.Fatal(err)
+	}
+	if content.String() != "blob content" {
+		t.Errorf("unexpected content %q", content.String())
+	}
+
+	info, err := hive.Stat("blob.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len("blob content")) {
+		t.Errorf("unexpected size %v", info.Size)
+	}
+
+	_, err = hive.Stat("missing.zst")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	if !strings.Contains(accessLog.String(), `"GET /blob.zst HTTP/1.1" 200 12`) {
+		t.Errorf("request not logged: %v", accessLog.String())
+	}
+}
+
+func TestDataServerRangeAndETag(t *testing.T) {
+	server, _ := newTestDataServer(t, map[string]string{
+		"blob.zst": "0123456789",
+	})
+
+	resp, body := get(t, server.URL+"/blob.zst", nil)
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Fatalf("unexpected response %v %q", resp.Status, body)
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Errorf("expected strong ETag, got %q", etag)
+	}
+	if !strings.Contains(resp.Header.Get("Cache-Control"), "immutable") {
+		t.Errorf("expected immutable caching, got %q", resp.Header.Get("Cache-Control"))
+	}
+
+	resp, body = get(t, server.URL+"/blob.zst", map[string]string{"Range": "bytes=4-"})
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "456789" {
+		t.Errorf("unexpected range response %v %q", resp.Status, body)
+	}
+
+	resp, _ = get(t, server.URL+"/blob.zst", map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Errorf("expected not modified, got %v", resp.Status)
+	}
+
+	// Range only if unchanged
+	resp, body = get(t, server.URL+"/blob.zst", map[string]string{"Range": "bytes=4-", "If-Range": `"other"`})
+	if resp.StatusCode != http.StatusOK || string(body) != "0123456789" {
+		t.Errorf("expected full content for stale If-Range, got %v %q", resp.Status, body)
+	}
+}
+
+func TestDataServerGzip(t *testing.T) {
+	manifest := `{"Version":2,"Changed":[]}`
+	server, _ := newTestDataServer(t, map[string]string{
+		"manifest.json": manifest,
+		"blob.zst":      "blob content",
+	})
+
+	resp, _ := get(t, server.URL+"/manifest.json", map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip, got %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Go's client decompresses transparently
+	hive, err := NewHTTP(server.URL, HTTPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hive.Close()
+
+	content := new(bytes.Buffer)
+	if err := hive.DownloadFile("manifest.json", content); err != nil {
+		t.Fatal(err)
+	}
+	if content.String() != manifest {
+		t.Errorf("unexpected content %q", content.String())
+	}
+
+	resp, _ = get(t, server.URL+"/blob.zst", map[string]string{"Accept-Encoding": "gzip"})
+	if resp.Header.Get("Content-Encoding") != "" {
+		t.Error("compressed chunks must not be gzipped")
+	}
+}
+
+func TestDataServerRefusesPaths(t *testing.T) {
+	server, _ := newTestDataServer(t, map[string]string{
+		".hidden": "secret",
+	})
+
+	for _, path := range []string{"/", "/.hidden", "/../server.go", "/sub/file", "/..%2fserver.go"} {
+		resp, _ := get(t, server.URL+path, nil)
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%v: expected not found, got %v", path, resp.Status)
+		}
+	}
+
+	resp, err := http.Post(server.URL+"/blob.zst", "application/octet-stream", strings.NewReader("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("expected method not allowed, got %v", resp.Status)
+	}
+}
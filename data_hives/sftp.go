@@ -1,22 +1,30 @@
 package data_hives
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
 )
 
 type sftpPersistence struct {
-	client    *sftp.Client
+	host      string
+	config    *ssh.ClientConfig
 	subfolder string
+
+	// Connections are opened on demand, one per concurrent operation up to maxConnections
+	maxConnections int
+	idle           chan *sftp.Client
+	mutex          sync.Mutex
+	clients        []*sftp.Client
+	numConnections int
 }
 
-func NewSFTP(host string, subfolder string, config *ssh.ClientConfig) (*sftpPersistence, error) {
+func NewSFTP(host string, subfolder string, config *ssh.ClientConfig, maxConnections int) (*sftpPersistence, error) {
 	client, err := connectSFTP(host, config)
 	if err != nil {
 		return nil, err
@@ -26,63 +34,200 @@ func NewSFTP(host string, subfolder string, config *ssh.ClientConfig) (*sftpPers
 		subfolder += "/"
 	}
 
-	return &sftpPersistence{
-		client:    client,
-		subfolder: subfolder,
-	}, nil
+	if maxConnections < 1 {
+		maxConnections = 1
+	}
+
+	p := &sftpPersistence{
+		host:           host,
+		config:         config,
+		subfolder:      subfolder,
+		maxConnections: maxConnections,
+		idle:           make(chan *sftp.Client, maxConnections),
+		clients:        []*sftp.Client{client},
+		numConnections: 1,
+	}
+	p.idle <- client
+	return p, nil
 }
 
 func (p *sftpPersistence) Close() {
-	p.client.Close()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for _, client := range p.clients {
+		client.Close()
+	}
+	p.clients = nil
+}
+
+// acquire returns an idle connection, opening a new one if none is idle and the limit isn't reached.
+func (p *sftpPersistence) acquire() (*sftp.Client, error) {
+	select {
+	case client := <-p.idle:
+		return client, nil
+	default:
+	}
+
+	p.mutex.Lock()
+	if p.numConnections >= p.maxConnections {
+		p.mutex.Unlock()
+		return <-p.idle, nil
+	}
+	p.numConnections++
+	p.mutex.Unlock()
+
+	client, err := connectSFTP(p.host, p.config)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if err != nil {
+		p.numConnections--
+		return nil, err
+	}
+
+	p.clients = append(p.clients, client)
+	return client, nil
 }
 
-func (p *sftpPersistence) UploadFile(fileName string, data []byte) error {
+func (p *sftpPersistence) release(client *sftp.Client) {
+	p.idle <- client
+}
+
+func (p *sftpPersistence) UploadFile(fileName string, r io.Reader) error {
 	fullPath := p.subfolder + fileName
 	fmt.Println(fullPath)
 
-	f, err := p.client.Create(fullPath)
+	client, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(client)
+
+	f, err := client.Create(fullPath)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 
-	_, err = f.Write(data)
+	_, err = io.Copy(f, r)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return f.Close()
 }
 
-func (p *sftpPersistence) DownloadFile(fileName string) ([]byte, error) {
+func (p *sftpPersistence) DownloadFile(fileName string, w io.Writer) error {
 	fullPath := p.subfolder + fileName
 	fmt.Println(fullPath)
 
-	f, err := p.client.Open(fullPath)
+	client, err := p.acquire()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer p.release(client)
+
+	f, err := client.Open(fullPath)
+	if err != nil {
+		return err
 	}
 	defer f.Close()
 
-	buf := bytes.NewBuffer(nil)
-	_, err = io.Copy(buf, f)
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (p *sftpPersistence) Stat(fileName string) (*FileInfo, error) {
+	fullPath := p.subfolder + fileName
+
+	client, err := p.acquire()
 	if err != nil {
 		return nil, err
 	}
+	defer p.release(client)
+
+	info, err := client.Stat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileInfo{
+		Name:    fileName,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}, nil
+}
+
+func (p *sftpPersistence) List(prefix string) ([]FileInfo, error) {
+	dir := p.subfolder
+	if dir == "" {
+		dir = "."
+	}
+
+	client, err := p.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer p.release(client)
+
+	files, err := client.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []FileInfo
+	for _, file := range files {
+		if file.IsDir() || !strings.HasPrefix(file.Name(), prefix) {
+			continue
+		}
+
+		result = append(result, FileInfo{
+			Name:    file.Name(),
+			Size:    file.Size(),
+			ModTime: file.ModTime(),
+		})
+	}
+
+	return result, nil
+}
+
+func (p *sftpPersistence) Delete(fileName string) error {
+	fullPath := p.subfolder + fileName
+	fmt.Println(fullPath)
+
+	client, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(client)
+
+	return client.Remove(fullPath)
+}
+
+func (p *sftpPersistence) Touch(fileName string) error {
+	fullPath := p.subfolder + fileName
+
+	client, err := p.acquire()
+	if err != nil {
+		return err
+	}
+	defer p.release(client)
 
-	return buf.Bytes(), nil
+	now := time.Now()
+	return client.Chtimes(fullPath, now, now)
 }
 
 func connectSFTP(host string, config *ssh.ClientConfig) (*sftp.Client, error) {
 	conn, err := ssh.Dial("tcp", host, config)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
 
 	client, err := sftp.NewClient(conn)
 	if err != nil {
-		log.Fatal(err)
+		conn.Close()
 		return nil, err
 	}
 
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binary deltas in the spirit of rsync/VCDIFF: the base file is cut into fixed blocks
+// which are indexed by a weak rolling checksum and a strong hash. The new file is then
+// scanned byte by byte and every block found in the base is replaced by a copy instruction.
+//
+// Format: magic followed by a stream of instructions
+//   'C' uvarint(offset) uvarint(length)  - copy bytes from the base
+//   'I' uvarint(length) bytes            - insert literal bytes
+
+const (
+	deltaMagic     = "TDLT1"
+	deltaOpCopy    = 'C'
+	deltaOpInsert  = 'I'
+	deltaMaxInsert = 1024 * 1024
+	// Smaller files aren't worth downloading the previous version for
+	deltaMinFileSize = 64 * 1024
+)
+
+type deltaBlock struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+type deltaSignature struct {
+	blockSize int
+	blocks    map[uint32][]deltaBlock
+}
+
+// deltaBlockSize keeps the number of blocks (and with it the size of the signature) bounded.
+func deltaBlockSize(size int64) int {
+	blockSize := 2048
+	for size/int64(blockSize) > 1<<18 {
+		blockSize *= 2
+	}
+	return blockSize
+}
+
+func computeSignature(base io.Reader, size int64) (*deltaSignature, error) {
+	sig := &deltaSignature{
+		blockSize: deltaBlockSize(size),
+		blocks:    make(map[uint32][]deltaBlock),
+	}
+
+	block := make([]byte, sig.blockSize)
+	var offset int64
+	for {
+		_, err := io.ReadFull(base, block)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break // The trailing partial block can never match a full window
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		weak := weakChecksum(block)
+		sig.blocks[weak] = append(sig.blocks[weak], deltaBlock{
+			offset: offset,
+			strong: sha256.Sum256(block),
+		})
+		offset += int64(sig.blockSize)
+	}
+
+	return sig, nil
+}
+
+func (sig *deltaSignature) find(weak uint32, window []byte) (int64, bool) {
+	candidates, ok := sig.blocks[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := sha256.Sum256(window)
+	for _, candidate := range candidates {
+		if candidate.strong == strong {
+			return candidate.offset, true
+		}
+	}
+	return 0, false
+}
+
+// weakChecksum is the rolling checksum used by rsync.
+func weakChecksum(block []byte) uint32 {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, x := range block {
+		a += uint32(x)
+		b += (l - uint32(i)) * uint32(x)
+	}
+	return (a & 0xffff) | (b << 16)
+}
+
+func rollChecksum(weak uint32, blockSize int, out byte, in byte) uint32 {
+	a := weak & 0xffff
+	b := weak >> 16
+	a = (a - uint32(out) + uint32(in)) & 0xffff
+	b = (b - uint32(blockSize)*uint32(out) + a) & 0xffff
+	return a | (b << 16)
+}
+
+type deltaWriter struct {
+	w         *bufio.Writer
+	copyStart int64
+	copyLen   int64
+	scratch   [binary.MaxVarintLen64]byte
+}
+
+func (dw *deltaWriter) uvarint(v int64) error {
+	n := binary.PutUvarint(dw.scratch[:], uint64(v))
+	_, err := dw.w.Write(dw.scratch[:n])
+	return err
+}
+
+func (dw *deltaWriter) copy(offset int64, length int64) error {
+	if dw.copyLen > 0 && dw.copyStart+dw.copyLen == offset {
+		dw.copyLen += length
+		return nil
+	}
+
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+
+	dw.copyStart = offset
+	dw.copyLen = length
+	return nil
+}
+
+func (dw *deltaWriter) flushCopy() error {
+	if dw.copyLen == 0 {
+		return nil
+	}
+
+	if err := dw.w.WriteByte(deltaOpCopy); err != nil {
+		return err
+	}
+	if err := dw.uvarint(dw.copyStart); err != nil {
+		return err
+	}
+	if err := dw.uvarint(dw.copyLen); err != nil {
+		return err
+	}
+
+	dw.copyLen = 0
+	return nil
+}
+
+func (dw *deltaWriter) insert(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+
+	if err := dw.w.WriteByte(deltaOpInsert); err != nil {
+		return err
+	}
+	if err := dw.uvarint(int64(len(data))); err != nil {
+		return err
+	}
+	_, err := dw.w.Write(data)
+	return err
+}
+
+// createDelta writes the instructions to turn the base described by sig into newContent.
+// newContent is streamed, memory use is bounded by the block size and deltaMaxInsert.
+func createDelta(sig *deltaSignature, newContent io.Reader, out io.Writer) error {
+	dw := &deltaWriter{w: bufio.NewWriter(out)}
+	if _, err := dw.w.WriteString(deltaMagic); err != nil {
+		return err
+	}
+
+	blockSize := sig.blockSize
+	buf := make([]byte, 0, deltaMaxInsert+4*blockSize)
+	start := 0 // Begin of pending literal bytes
+	pos := 0   // Begin of the current window
+	eof := false
+	rolled := false
+	var weak uint32
+
+	for {
+		// Make sure there is a full window in the buffer
+		if len(buf)-pos < blockSize && !eof {
+			if start > 0 {
+				n := copy(buf, buf[start:])
+				buf = buf[:n]
+				pos -= start
+				start = 0
+			}
+
+			for len(buf)-pos < blockSize && !eof {
+				n, err := newContent.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+n]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+
+		if len(buf)-pos < blockSize {
+			break
+		}
+
+		window := buf[pos : pos+blockSize]
+		if !rolled {
+			weak = weakChecksum(window)
+			rolled = true
+		}
+
+		if offset, ok := sig.find(weak, window); ok {
+			if err := dw.insert(buf[start:pos]); err != nil {
+				return err
+			}
+			if err := dw.copy(offset, int64(blockSize)); err != nil {
+				return err
+			}
+
+			pos += blockSize
+			start = pos
+			rolled = false
+			continue
+		}
+
+		if pos-start >= deltaMaxInsert {
+			if err := dw.insert(buf[start:pos]); err != nil {
+				return err
+			}
+			start = pos
+		}
+
+		pos++
+		if len(buf)-pos >= blockSize {
+			weak = rollChecksum(weak, blockSize, buf[pos-1], buf[pos+blockSize-1])
+		} else {
+			rolled = false
+		}
+	}
+
+	if err := dw.insert(buf[start:]); err != nil {
+		return err
+	}
+	if err := dw.flushCopy(); err != nil {
+		return err
+	}
+	return dw.w.Flush()
+}
+
+// applyDelta reconstructs the new file from base and the delta created by createDelta.
+func applyDelta(base io.ReaderAt, delta io.Reader, out io.Writer) error {
+	r := bufio.NewReader(delta)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if !bytes.Equal(magic, []byte(deltaMagic)) {
+		return errors.New("not a delta")
+	}
+
+	for {
+		op, err := r.ReadByte()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+
+			n, err := io.Copy(out, io.NewSectionReader(base, int64(offset), int64(length)))
+			if err != nil {
+				return err
+			}
+			if n != int64(length) {
+				return errors.New("delta references data beyond the end of the base")
+			}
+
+		case deltaOpInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+
+			if _, err := io.CopyN(out, r, int64(length)); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("invalid delta instruction %v", op)
+		}
+	}
+}
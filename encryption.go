@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/OneManMonkeySquad/transport-cli/data_hives"
+)
+
+// Encrypted files are AES-256-GCM encrypted in segments, so files of any size can be streamed:
+//
+//	"TENC1" | key ID length (1 byte) | key ID | nonce prefix (8 bytes) | segments
+//
+// Every segment holds up to encryptionSegmentSize bytes plus the GCM tag. Its nonce is the
+// prefix followed by the segment index, the header and a final flag are authenticated with it,
+// so segments can't be reordered, dropped or truncated. The key ID names the key the file was
+// encrypted with, old keys stay configured to read files written before a key rotation.
+
+const (
+	encryptionMagic       = "TENC1"
+	encryptionSegmentSize = 64 * 1024
+	encryptionNonceSize   = 8
+)
+
+type encryptionKeys struct {
+	// Key used for new files
+	current string
+	keys    map[string]cipher.AEAD
+	// Read files written before encryption was enabled as they are
+	allowUnencrypted bool
+}
+
+// parseEncryptionKeys parses base64 encoded 256 bit keys by key ID.
+func parseEncryptionKeys(current string, keys map[string]string) (*encryptionKeys, error) {
+	result := &encryptionKeys{
+		current: current,
+		keys:    make(map[string]cipher.AEAD),
+	}
+
+	for keyID, keyStr := range keys {
+		if keyID == "" || len(keyID) > 255 {
+			return nil, fmt.Errorf("invalid encryption key ID '%v'", keyID)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(keyStr))
+		if err != nil {
+			return nil, fmt.Errorf("encryption key '%v': %v", keyID, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key '%v': must be 32 bytes", keyID)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		result.keys[keyID] = aead
+	}
+
+	if result.current == "" && len(keys) == 1 {
+		for keyID := range keys {
+			result.current = keyID
+		}
+	}
+	if _, ok := result.keys[result.current]; !ok {
+		keyIDs := make([]string, 0, len(keys))
+		for keyID := range keys {
+			keyIDs = append(keyIDs, keyID)
+		}
+		sort.Strings(keyIDs)
+		return nil, fmt.Errorf("encryption key_id '%v' is not one of the keys %v", result.current, keyIDs)
+	}
+
+	return result, nil
+}
+
+func encryptionHeader(keyID string, noncePrefix []byte) []byte {
+	header := []byte(encryptionMagic)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	return append(header, noncePrefix...)
+}
+
+func segmentNonce(noncePrefix []byte, index uint32) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, noncePrefix)
+	binary.BigEndian.PutUint32(nonce[encryptionNonceSize:], index)
+	return nonce
+}
+
+func segmentAdditionalData(header []byte, final bool) []byte {
+	flag := byte(0)
+	if final {
+		flag = 1
+	}
+	return append(append([]byte{}, header...), flag)
+}
+
+// encrypt encrypts r into w with the current key.
+func (k *encryptionKeys) encrypt(w io.Writer, r io.Reader) error {
+	aead := k.keys[k.current]
+
+	noncePrefix := make([]byte, encryptionNonceSize)
+	if _, err := rand.Read(noncePrefix); err != nil {
+		return err
+	}
+
+	header := encryptionHeader(k.current, noncePrefix)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	reader := bufio.NewReaderSize(r, encryptionSegmentSize)
+	segment := make([]byte, encryptionSegmentSize)
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		final := n < encryptionSegmentSize
+		if !final {
+			if _, err := reader.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed := aead.Seal(nil, segmentNonce(noncePrefix, index), segment[:n], segmentAdditionalData(header, final))
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// decrypt decrypts r into w with the key named in the header.
+func (k *encryptionKeys) decrypt(w io.Writer, r io.Reader) error {
+	reader := bufio.NewReaderSize(r, encryptionSegmentSize+64)
+
+	prefix := make([]byte, len(encryptionMagic)+1)
+	n, err := io.ReadFull(reader, prefix)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < len(prefix) || !bytes.Equal(prefix[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		if !k.allowUnencrypted {
+			return errors.New("not encrypted, set allow_unencrypted to read files from before encryption was enabled")
+		}
+
+		if _, err := w.Write(prefix[:n]); err != nil {
+			return err
+		}
+		_, err := io.Copy(w, reader)
+		return err
+	}
+
+	rest := make([]byte, int(prefix[len(encryptionMagic)])+encryptionNonceSize)
+	if _, err := io.ReadFull(reader, rest); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errors.New("encryption header truncated")
+	} else if err != nil {
+		return err
+	}
+	keyID := string(rest[:len(rest)-encryptionNonceSize])
+	noncePrefix := rest[len(rest)-encryptionNonceSize:]
+	header := append(prefix, rest...)
+
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return fmt.Errorf("encrypted with unknown key '%v'", keyID)
+	}
+
+	sealed := make([]byte, encryptionSegmentSize+aead.Overhead())
+	for index := uint32(0); ; index++ {
+		n, err := io.ReadFull(reader, sealed)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		final := n < len(sealed)
+		if !final {
+			if _, err := reader.Peek(1); err == io.EOF {
+				final = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		segment, err := aead.Open(nil, segmentNonce(noncePrefix, index), sealed[:n], segmentAdditionalData(header, final))
+		if err != nil {
+			return fmt.Errorf("%w: decryption failed, content was modified or truncated", errCorruptContent)
+		}
+
+		if _, err := w.Write(segment); err != nil {
+			return err
+		}
+
+		if final {
+			return nil
+		}
+	}
+}
+
+// plainSize returns the size of the content of an encrypted file written with the current key.
+func (k *encryptionKeys) plainSize(size int64) int64 {
+	segments := size - int64(len(encryptionMagic)+1+len(k.current)+encryptionNonceSize)
+	sealedSegmentSize := int64(encryptionSegmentSize + k.keys[k.current].Overhead())
+	numSegments := (segments + sealedSegmentSize - 1) / sealedSegmentSize
+	return segments - numSegments*int64(k.keys[k.current].Overhead())
+}
+
+// encryptedDataHive encrypts every file before it is uploaded and decrypts it after download.
+// It wraps the cache, the cache only ever holds encrypted files.
+type encryptedDataHive struct {
+	inner DataHive
+	keys  *encryptionKeys
+}
+
+func (p *encryptedDataHive) Close() {
+	p.inner.Close()
+}
+
+func (p *encryptedDataHive) UploadFile(fileName string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(p.keys.encrypt(pw, r))
+	}()
+
+	err := p.inner.UploadFile(fileName, pr)
+	pr.CloseWithError(err)
+	return err
+}
+
+func (p *encryptedDataHive) DownloadFile(fileName string, w io.Writer) error {
+	pr, pw := io.Pipe()
+	downloadErr := make(chan error, 1)
+	go func() {
+		err := p.inner.DownloadFile(fileName, pw)
+		pw.CloseWithError(err)
+		downloadErr <- err
+	}()
+
+	err := p.keys.decrypt(w, pr)
+	pr.CloseWithError(err)
+
+	// Either the download failed and decrypt saw its error, or decrypt failed and the download
+	// saw the closed pipe
+	dlErr := <-downloadErr
+	if dlErr != nil && (err == nil || errors.Is(err, dlErr)) {
+		return dlErr
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %v", fileName, err)
+	}
+	return nil
+}
+
+// Stat returns the size of the content. Files not encrypted with the current key report size -1,
+// so commit uploads them again with the current key. Reading the key ID costs a request, it's
+// only done while other keys or unencrypted files are accepted. Otherwise every readable file
+// uses the current key.
+func (p *encryptedDataHive) Stat(fileName string) (*data_hives.FileInfo, error) {
+	info, err := p.inner.Stat(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	plainInfo := *info
+	plainInfo.Size = p.keys.plainSize(info.Size)
+	if len(p.keys.keys) == 1 && !p.keys.allowUnencrypted {
+		return &plainInfo, nil
+	}
+
+	keyID, err := p.keyID(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if keyID != p.keys.current {
+		plainInfo.Size = -1
+	}
+	return &plainInfo, nil
+}
+
+var errHeaderComplete = errors.New("header complete")
+
+// headerWriter takes the encryption header and stops the download afterwards.
+type headerWriter struct {
+	header []byte
+}
+
+func (w *headerWriter) Write(p []byte) (int, error) {
+	w.header = append(w.header, p...)
+	if len(w.header) > len(encryptionMagic) && len(w.header) >= len(encryptionMagic)+1+int(w.header[len(encryptionMagic)]) {
+		return len(p), errHeaderComplete
+	}
+	return len(p), nil
+}
+
+// keyID returns the ID of the key the file was encrypted with, empty if not encrypted.
+func (p *encryptedDataHive) keyID(fileName string) (string, error) {
+	// The cache would download the whole file before passing anything on
+	backend := p.inner
+	if cached, ok := backend.(*cachedDataHive); ok && cached.remote != nil {
+		backend = cached.remote
+	}
+
+	w := &headerWriter{}
+	err := backend.DownloadFile(fileName, w)
+	if err != nil && !errors.Is(err, errHeaderComplete) {
+		return "", err
+	}
+
+	header := w.header
+	if len(header) <= len(encryptionMagic) || !bytes.Equal(header[:len(encryptionMagic)], []byte(encryptionMagic)) {
+		return "", nil
+	}
+	keyIDLength := int(header[len(encryptionMagic)])
+	if len(header) < len(encryptionMagic)+1+keyIDLength {
+		return "", nil
+	}
+	return string(header[len(encryptionMagic)+1 : len(encryptionMagic)+1+keyIDLength]), nil
+}
+
+func (p *encryptedDataHive) List(prefix string) ([]data_hives.FileInfo, error) {
+	return p.inner.List(prefix)
+}
+
+func (p *encryptedDataHive) Delete(fileName string) error {
+	return p.inner.Delete(fileName)
+}
+
+func (p *encryptedDataHive) Touch(fileName string) error {
+	return p.inner.Touch(fileName)
+}
+
+func (p *encryptedDataHive) Evict(fileName string) bool {
+	return evictCorrupt(p.inner, fileName)
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// exchangePaths atomically swaps two paths, not supported on this OS.
+func exchangePaths(oldPath string, newPath string) error {
+	return errExchangeUnsupported
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// Names of files written by transport-cli. Everything else in the data hive is left alone.
+var (
+	manifestNamePattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\.json$`)
+	chunkNamePattern    = regexp.MustCompile(`^[0-9a-f]{64}\.(zst|zlib|raw)$`)
+	legacyNamePattern   = regexp.MustCompile(`^[0-9a-f]{64}(-[0-9a-f]{64})?(_[0-9]+)?$`)
+)
+
+func isHiveFileName(fileName string) bool {
+	return manifestNamePattern.MatchString(fileName) || chunkNamePattern.MatchString(fileName) || legacyNamePattern.MatchString(fileName)
+}
+
+// gc deletes all data hive files not reachable from any tag. Files younger than gracePeriod are
+// kept, they might belong to a commit in progress.
+func gc(cfg *Config, gracePeriod time.Duration, dryRun bool) error {
+	if gracePeriod <= maxUntouchedAge {
+		return fmt.Errorf("grace period has to be longer than %v, commits reuse files that old without touching them", maxUntouchedAge)
+	}
+
+	reachable, err := findReachableFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	files, err := cfg.dataHive.List("")
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(-gracePeriod)
+
+	var numDeleted, numKept int
+	var reclaimed int64
+	for _, file := range files {
+		if _, ok := reachable[file.Name]; ok || !isHiveFileName(file.Name) {
+			continue
+		}
+
+		if file.ModTime.After(deadline) {
+			fmt.Printf("Keeping %v, younger than grace period\n", file.Name)
+			numKept++
+			continue
+		}
+
+		if dryRun {
+			fmt.Printf("Would delete %v (%d bytes)\n", file.Name, file.Size)
+		} else {
+			// A commit might have touched it since the listing to reuse it
+			if info, err := cfg.dataHive.Stat(file.Name); err == nil && info.ModTime.After(deadline) {
+				fmt.Printf("Keeping %v, touched by a commit\n", file.Name)
+				numKept++
+				continue
+			}
+
+			fmt.Printf("Deleting %v (%d bytes)\n", file.Name, file.Size)
+			if err := cfg.dataHive.Delete(file.Name); err != nil {
+				return fmt.Errorf("delete %v: %v", file.Name, err)
+			}
+		}
+
+		numDeleted++
+		reclaimed += file.Size
+	}
+
+	verb := "Reclaimed"
+	if dryRun {
+		verb = "Would reclaim"
+	}
+	fmt.Printf("%s %d bytes in %d files, %d unreferenced files within grace period, %d files reachable\n", verb, reclaimed, numDeleted, numKept, len(reachable))
+
+	return nil
+}
+
+// findReachableFiles returns the names of all manifests and chunks referenced by any tag.
+func findReachableFiles(cfg *Config) (map[string]struct{}, error) {
+	tags, err := cfg.metaHive.Tags()
+	if err != nil {
+		return nil, err
+	}
+
+	reachable := make(map[string]struct{})
+	for _, tag := range tags {
+		restoreChain, err := findRestoreChain(cfg.metaHive, tag.Id)
+		if err != nil {
+			return nil, fmt.Errorf("tag '%v': %v", tag.Name, err)
+		}
+
+		patchFiles, err := downloadPatchFiles(cfg, restoreChain)
+		if err != nil {
+			return nil, fmt.Errorf("tag '%v': %v", tag.Name, err)
+		}
+
+		for i, patchFile := range patchFiles {
+			reachable[restoreChain[i].String()+".json"] = struct{}{}
+
+			for _, entry := range patchFile.Changed {
+				for _, name := range entry.Blob().ChunkNames() {
+					reachable[name] = struct{}{}
+				}
+				if entry.Delta != nil {
+					for _, name := range entry.DeltaBlob().ChunkNames() {
+						reachable[name] = struct{}{}
+					}
+				}
+			}
+		}
+	}
+
+	return reachable, nil
+}
@@ -6,9 +6,12 @@ require (
 	github.com/alecthomas/kong v0.4.1
 	github.com/aws/aws-sdk-go v1.43.7
 	github.com/google/uuid v1.3.0
+	github.com/klauspost/compress v1.15.15
+	github.com/mattn/go-sqlite3 v1.14.11
 	github.com/pelletier/go-toml v1.9.4
 	github.com/pkg/sftp v1.13.4
 	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/sys v0.0.0-20220224120231-95c6836cb0e7
 )
 
 require (
@@ -16,11 +19,9 @@ require (
 	github.com/go-sql-driver/mysql v1.6.0 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/kr/fs v0.1.0 // indirect
-	github.com/mattn/go-sqlite3 v1.14.11 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.3.0 // indirect
 	github.com/stretchr/testify v1.7.1-0.20210427113832-6241f9ab9942 // indirect
-	golang.org/x/sys v0.0.0-20220224120231-95c6836cb0e7 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
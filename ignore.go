@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Name of the files holding ignore rules for their directory. They are never packaged themselves.
+const ignoreFileName = ".transportignore"
+
+// ignoreRule is a gitignore-style pattern, f.i. "*.pdb", "/config.local", "logs/" or "!keep.log".
+type ignoreRule struct {
+	// Slash separated directory of the ignore file, relative to the source directory
+	base    string
+	regex   *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// ignoreRules are the rules in effect for one directory. Later rules take precedence: ignore files
+// of subdirectories over the ones of their parents, --exclude/--include over all of them.
+type ignoreRules struct {
+	fileRules []ignoreRule
+	flagRules []ignoreRule
+}
+
+// newIgnoreRules creates the rules given on the command line. Includes take precedence over excludes.
+func newIgnoreRules(excludes []string, includes []string) (*ignoreRules, error) {
+	rules := &ignoreRules{}
+	for _, pattern := range excludes {
+		rule, err := parseIgnoreRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		rules.flagRules = append(rules.flagRules, *rule)
+	}
+	for _, pattern := range includes {
+		rule, err := parseIgnoreRule("", pattern)
+		if err != nil {
+			return nil, err
+		}
+		rule.negate = !rule.negate
+		rules.flagRules = append(rules.flagRules, *rule)
+	}
+	return rules, nil
+}
+
+// withIgnoreFile returns the rules for the directory dirPath, named fileName relative to the
+// source directory. Rules of its ignore file are added if there is one.
+func (r *ignoreRules) withIgnoreFile(dirPath string, fileName string) (*ignoreRules, error) {
+	file, err := os.Open(filepath.Join(dirPath, ignoreFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	result := &ignoreRules{
+		fileRules: append([]ignoreRule{}, r.fileRules...),
+		flagRules: r.flagRules,
+	}
+
+	base := filepath.ToSlash(fileName)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		pattern := strings.TrimRight(scanner.Text(), " \t\r")
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		rule, err := parseIgnoreRule(base, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", filepath.Join(dirPath, ignoreFileName), line, err)
+		}
+		result.fileRules = append(result.fileRules, *rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func parseIgnoreRule(base string, pattern string) (*ignoreRule, error) {
+	rule := &ignoreRule{base: base}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, `\!`) || strings.HasPrefix(pattern, `\#`) {
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return nil, errors.New("empty pattern")
+	}
+
+	// Patterns with a slash are relative to the ignore file, others match at any depth
+	prefix := "(.*/)?"
+	if strings.Contains(pattern, "/") {
+		prefix = ""
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+
+	regex, err := regexp.Compile("^" + prefix + globToRegex(pattern) + "$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern '%v': %v", pattern, err)
+	}
+	rule.regex = regex
+	return rule, nil
+}
+
+// globToRegex translates a gitignore glob: * and ? don't match slashes, ** matches any number of
+// directories.
+func globToRegex(pattern string) string {
+	var regex strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			regex.WriteString("(.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			regex.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			regex.WriteString(".*")
+			i++
+		case c == '*':
+			regex.WriteString("[^/]*")
+		case c == '?':
+			regex.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				regex.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			regex.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			regex.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			regex.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	return regex.String()
+}
+
+// ignored returns whether the entry fileName, relative to the source directory, is ignored.
+func (r *ignoreRules) ignored(fileName string, isDir bool) bool {
+	name := filepath.ToSlash(fileName)
+
+	ignored := false
+	for _, rules := range [][]ignoreRule{r.fileRules, r.flagRules} {
+		for _, rule := range rules {
+			if rule.dirOnly && !isDir {
+				continue
+			}
+
+			rel := name
+			if rule.base != "" {
+				if !strings.HasPrefix(name, rule.base+"/") {
+					continue
+				}
+				rel = name[len(rule.base)+1:]
+			}
+
+			if rule.regex.MatchString(rel) {
+				ignored = !rule.negate
+			}
+		}
+	}
+	return ignored
+}
+
+// ignoredInScan returns whether a file that doesn't exist (anymore) would have been ignored, by
+// itself or by one of its directories. The rules of the deepest scanned directory above it are
+// used, rulesByDir is keyed by slash separated paths, "" is the source directory.
+func ignoredInScan(rulesByDir map[string]*ignoreRules, fileName string, isDir bool) bool {
+	components := strings.Split(filepath.ToSlash(fileName), "/")
+
+	depth := 0
+	rules := rulesByDir[""]
+	for i := 1; i < len(components); i++ {
+		dirRules, ok := rulesByDir[strings.Join(components[:i], "/")]
+		if !ok {
+			break
+		}
+		rules, depth = dirRules, i
+	}
+
+	// A missing directory in between might be ignored too
+	for i := depth + 1; i <= len(components); i++ {
+		if rules.ignored(strings.Join(components[:i], "/"), i < len(components) || isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPath returns whether fileName or one of its directories is ignored.
+func (r *ignoreRules) ignoredPath(fileName string, isDir bool) bool {
+	return ignoredInScan(map[string]*ignoreRules{"": r}, fileName, isDir)
+}
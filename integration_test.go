@@ -1,31 +1,67 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pelletier/go-toml"
 
 	"github.com/OneManMonkeySquad/transport-cli/data_hives"
 	"github.com/OneManMonkeySquad/transport-cli/meta_hives"
 )
 
 func TestBaseRestore(t *testing.T) {
-	metaHive, err := meta_hives.NewSqlite("local_db/test.db")
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	dataHive := data_hives.NewLocal("local_db")
-	cfg := NewConfig(metaHive, dataHive)
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+}
+
+func TestPatchRestore(t *testing.T) {
+	cfg := newTestConfig(t)
 	defer cfg.dataHive.Close()
 
-	os.RemoveAll("local_db")
-	os.MkdirAll("local_db", 0777)
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	os.RemoveAll("out")
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	err = version(cfg, "test_data/base1")
+	err = patch(cfg, "latest", "test_data/patch1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -35,30 +71,256 @@ func TestBaseRestore(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = restore(cfg, "latest", "out")
+	err = restore(cfg, "latest", "out", restoreOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	compareDirs(t, "out", "test_data/base1")
+	compareDirs(t, "out", "test_data/patch1")
 }
 
-func TestPatchRestore(t *testing.T) {
-	metaHive, err := meta_hives.NewSqlite("local_db/test.db")
+func TestDeltaRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src", 0777)
+	defer os.RemoveAll("out_src")
+
+	content := make([]byte, 1024*1024)
+	rand.New(rand.NewSource(1)).Read(content)
+	if err := os.WriteFile("out_src/big", content, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("out_src/small", content[:1000], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err := version(cfg, "out_src", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	dataHive := data_hives.NewLocal("local_db")
-	cfg := NewConfig(metaHive, dataHive)
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert a few bytes in the middle
+	changed := append(append(append([]byte{}, content[:500000]...), []byte("some new bytes")...), content[500000:]...)
+	if err := os.WriteFile("out_src/big", changed, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("out_src/small", content[1:1001], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	if len(staged.Changed) != 2 {
+		t.Fatalf("expected 2 changed files, got %v", len(staged.Changed))
+	}
+	for _, entry := range staged.Changed {
+		if entry.FileName == "big" && entry.Delta == nil {
+			t.Error("expected delta")
+		}
+		if entry.FileName == "small" && entry.Delta != nil {
+			t.Error("expected no delta for small file")
+		}
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Local file matches the base, delta is applied
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+
+	// Local file doesn't match the base, full blob is used
+	if err := os.WriteFile("out/big", []byte("garbage"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+}
+
+func TestChunkDeduplication(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.chunkSizeMb = 1
 	defer cfg.dataHive.Close()
 
-	os.RemoveAll("local_db")
-	os.MkdirAll("local_db", 0777)
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src", 0777)
+	defer os.RemoveAll("out_src")
 
-	os.RemoveAll("out")
+	content := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(2)).Read(content)
+	if err := os.WriteFile("out_src/big", content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err := version(cfg, "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	numChunks := len(staged.Changed[0].Chunks)
+	if numChunks < 8 {
+		t.Fatalf("expected many chunks, got %v", numChunks)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Insert a byte near the start, only the first chunk should change
+	changed := append([]byte{42}, content...)
+	if err := os.WriteFile("out_src/big", changed, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stagedChunks, err := filepath.Glob(".staging/*.zlib")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Changed chunk plus delta
+	if len(stagedChunks) > 2 {
+		t.Fatalf("expected at most 2 staged chunks, got %v of %v", len(stagedChunks), numChunks)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+}
+
+func TestChunkSizes(t *testing.T) {
+	content := make([]byte, 32*1024*1024)
+	rand.New(rand.NewSource(4)).Read(content)
+
+	// The default limit is far above the chunk size
+	c := newChunker(bytes.NewReader(content), NewConfig(nil, nil).ChunkSize())
+	defer c.Close()
+	numChunks := 0
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > chunkMaxSize {
+			t.Fatalf("chunk of %v bytes", len(chunk))
+		}
+		numChunks++
+	}
 
-	err = version(cfg, "test_data/base1")
+	if numChunks < 16 || numChunks > 64 {
+		t.Errorf("expected chunks of about %v bytes, got %v chunks", chunkAvgSize, numChunks)
+	}
+}
+
+func TestCompressionCodecs(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src", 0777)
+	defer os.RemoveAll("out_src")
+
+	random := make([]byte, 64*1024)
+	rand.New(rand.NewSource(3)).Read(random)
+	if err := os.WriteFile("out_src/random", random, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("out_src/text", bytes.Repeat([]byte("hello world "), 8*1024), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err := version(cfg, "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	for _, entry := range staged.Changed {
+		expected := codecZstd
+		if entry.FileName == "random" {
+			expected = codecNone
+		}
+		if entry.Codec != expected {
+			t.Errorf("%v: expected codec %v, got %v", entry.FileName, expected, entry.Codec)
+		}
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.codec = codecZlib
+	if err := os.WriteFile("out_src/text", bytes.Repeat([]byte("hello transport "), 8*1024), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+}
+
+func TestRestoreRollback(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -68,17 +330,81 @@ func TestPatchRestore(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = patch(cfg, "latest", "test_data/patch1")
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	staged := readPatchFile(".staging/staged.json")
+
 	err = commit(cfg, "latest")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = restore(cfg, "latest", "out")
+	// Break the patch, restore has to fail without touching the directory
+	for _, entry := range staged.Changed {
+		for _, name := range entry.Blob().ChunkNames() {
+			os.Rename(filepath.Join("local_db", name), filepath.Join("local_db", name+".bak"))
+		}
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err == nil {
+		t.Fatal("expected restore to fail")
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+	if _, err := os.Stat(restoreStagingPath(mustAbs(t, "out"))); !os.IsNotExist(err) {
+		t.Error("staging directory not removed")
+	}
+
+	for _, entry := range staged.Changed {
+		for _, name := range entry.Blob().ChunkNames() {
+			os.Rename(filepath.Join("local_db", name+".bak"), filepath.Join("local_db", name))
+		}
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+
+	err = rollback("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// Rollback interrupted after moving the directory away
+	outPath := mustAbs(t, "out")
+	if err := os.Rename(outPath, rollbackTmpPath(outPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = rollback("out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+	compareDirs(t, restorePrevPath(outPath), "test_data/base1")
+
+	// Restore interrupted after moving the directory away
+	os.RemoveAll(restorePrevPath(outPath))
+	if err := os.Rename(outPath, restorePrevPath(outPath)); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -86,6 +412,1500 @@ func TestPatchRestore(t *testing.T) {
 	compareDirs(t, "out", "test_data/patch1")
 }
 
+func TestCleanRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	protected, err := newIgnoreRules([]string{"saves/", "/config.local", "file2"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.protected = protected
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll("out/saves/slot1", 0777)
+	os.MkdirAll("out/junk/empty", 0777)
+	os.WriteFile("out/crash.dmp", []byte("dump"), 0666)
+	os.WriteFile("out/dir/extra.txt", []byte("extra"), 0666)
+	os.WriteFile("out/saves/slot1/save", []byte("save"), 0666)
+	os.WriteFile("out/config.local", []byte("local"), 0666)
+	os.WriteFile("out/file2", []byte("modified by the user"), 0666)
+
+	// Without clean, untracked files stay
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat("out/crash.dmp"); err != nil {
+		t.Error("untracked file removed")
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{clean: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"crash.dmp", "dir/extra.txt", "junk"} {
+		if _, err := os.Lstat(filepath.Join("out", name)); !os.IsNotExist(err) {
+			t.Errorf("%v not removed", name)
+		}
+	}
+	for name, content := range map[string]string{"saves/slot1/save": "save", "config.local": "local", "file2": "modified by the user"} {
+		if data, err := os.ReadFile(filepath.Join("out", name)); err != nil || string(data) != content {
+			t.Errorf("protected %v touched", name)
+		}
+	}
+	for _, name := range []string{"file1", "dir/file1.txt"} {
+		if _, err := os.Stat(filepath.Join("out", name)); err != nil {
+			t.Errorf("%v missing", name)
+		}
+	}
+}
+
+func TestRestoreReceipt(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt := readReceipt("out")
+	if receipt == nil {
+		t.Fatal("no receipt")
+	}
+	if receipt.Tag != "latest" || receipt.EntryID != tag.Id {
+		t.Errorf("unexpected receipt %v %v", receipt.Tag, receipt.EntryID)
+	}
+	if len(receipt.Files) != 3 {
+		t.Errorf("expected 3 files, got %v", len(receipt.Files))
+	}
+
+	// Same size and modification time, the receipt is trusted and the file isn't read
+	info, err := os.Stat("out/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage := bytes.Repeat([]byte{'x'}, int(info.Size()))
+	os.WriteFile("out/file1", garbage, 0666)
+	os.Chtimes("out/file1", info.ModTime(), info.ModTime())
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if content, _ := os.ReadFile("out/file1"); !bytes.Equal(content, garbage) {
+		t.Error("file was hashed despite matching the receipt")
+	}
+
+	// Changed modification time, the file is hashed and repaired
+	os.Chtimes("out/file1", time.Now(), time.Now())
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// Versions made from a restored directory leave out the receipt
+	err = version(cfg, "out", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	for _, entry := range staged.Changed {
+		if strings.HasPrefix(entry.FileName, receiptDirName) {
+			t.Errorf("receipt staged: %v", entry.FileName)
+		}
+	}
+}
+
+func TestIncrementalRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versionTag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The manifest of the installed version isn't needed anymore
+	versionManifest := filepath.Join("local_db", versionTag.Id.String()+".json")
+	os.Rename(versionManifest, versionManifest+".bak")
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+	if _, err := os.Stat("out/dir/file1.txt"); !os.IsNotExist(err) {
+		t.Error("deleted file still there")
+	}
+
+	// A diverged directory is restored from the start of the chain, which needs the manifest
+	os.WriteFile("out/file3", []byte("changed"), 0666)
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err == nil {
+		t.Fatal("expected full restore")
+	}
+
+	os.Rename(versionManifest+".bak", versionManifest)
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+
+	// Without receipt, the installed entry is found by hashes
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreChain, err := findRestoreChain(cfg.metaHive, tag.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patchFiles, err := downloadPatchFiles(cfg, restoreChain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for dir, expected := range map[string]int{"test_data/base1": 0, "test_data/patch1": 1, "test_data": -1} {
+		receipt, installed, err := receiptFromHashes(cfg, dir, restoreChain, patchFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if installed != expected || (receipt != nil) != (expected >= 0) {
+			t.Errorf("%v: expected entry %v, got %v", dir, expected, installed)
+		}
+		if receipt != nil && receipt.EntryID != restoreChain[installed] {
+			t.Errorf("%v: receipt of wrong entry", dir)
+		}
+	}
+
+	os.RemoveAll("out/" + receiptDirName)
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+	if receipt := readReceipt("out"); receipt == nil || receipt.EntryID != tag.Id {
+		t.Error("expected receipt of the head")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirty, err := status(cfg, "latest", "out", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dirty {
+		t.Error("restored directory is dirty")
+	}
+
+	os.WriteFile("out/file1", []byte("changed"), 0666)
+	os.Remove("out/file3")
+	os.WriteFile("out/new.txt", []byte("new"), 0666)
+	os.MkdirAll("out/dir", 0777)
+	os.WriteFile("out/dir/file1.txt", []byte("leftover"), 0666)
+
+	report, err := compareToTag(cfg, "latest", "out")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"dir":           statusExtra,
+		"dir/file1.txt": statusExtra,
+		"file1":         statusModified,
+		"file3":         statusMissing,
+		"new.txt":       statusAdded,
+	}
+	if len(report.Files) != len(expected) {
+		t.Errorf("expected %v differences, got %+v", len(expected), report.Files)
+	}
+	for _, file := range report.Files {
+		if expected[filepath.ToSlash(file.FileName)] != file.Status {
+			t.Errorf("%v: expected %v, got %v", file.FileName, expected[file.FileName], file.Status)
+		}
+		if file.FileName == "file1" && (file.Size != 7 || file.ExpectedSize == 0) {
+			t.Errorf("unexpected sizes %+v", file)
+		}
+	}
+
+	dirty, err = status(cfg, "latest", "out", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dirty {
+		t.Error("changed directory is clean")
+	}
+}
+
+func TestOfflineRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("local_cache")
+	defer os.RemoveAll("local_cache")
+
+	cache, err := newChunkCache("local_cache", 1024*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.cache = cache
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.dataHive = &cachedDataHive{remote: cfg.dataHive, cache: cache}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offlineCfg := NewConfig(nil, &cachedDataHive{cache: cache})
+	offlineCfg.cache = cache
+	offlineCfg.offline = true
+
+	os.RemoveAll("out")
+
+	err = restore(offlineCfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// Corrupt cached chunks are evicted and downloaded again
+	cached, err := filepath.Glob("local_cache/blobs/*.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) == 0 {
+		t.Fatal("expected cached chunks")
+	}
+	for _, filePath := range cached {
+		os.WriteFile(filePath, []byte("garbage"), 0666)
+	}
+
+	os.RemoveAll("out")
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+}
+
+func TestRestoreBiggerThanCache(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.chunkSizeMb = 1
+	cfg.parallelism = 1
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src", 0777)
+	defer os.RemoveAll("out_src")
+
+	os.RemoveAll("local_cache")
+	defer os.RemoveAll("local_cache")
+
+	content := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(3)).Read(content)
+	if err := os.WriteFile("out_src/big", content, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	err := version(cfg, "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	numChunks := len(staged.Changed[0].Chunks)
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err := newChunkCache("local_cache", 2*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &testDataHive{DataHive: cfg.dataHive, failAfter: -1}
+	cfg.cache = cache
+	cfg.dataHive = &cachedDataHive{remote: counting, cache: cache}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+
+	// Every chunk once, plus the manifest
+	if counting.downloads != numChunks+1 {
+		t.Errorf("expected %v downloads, got %v", numChunks+1, counting.downloads)
+	}
+
+	// Back within its size after the restore
+	var size int64
+	filepath.WalkDir("local_cache/blobs", func(filePath string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !isManifest(d.Name()) {
+			info, _ := d.Info()
+			size += info.Size()
+		}
+		return nil
+	})
+	if size > 2*1024*1024 {
+		t.Errorf("cache not shrunk, %v bytes", size)
+	}
+}
+
+func TestCacheNamespace(t *testing.T) {
+	identity := func(config string) string {
+		tree, err := toml.Load(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hiveIdentity(tree)
+	}
+
+	product1 := identity("data_hive = \"http\"\nmeta_hive = \"server\"\n[http]\nhost = \"https://cdn.example.com/product1\"\n[server]\naddress = \"https://meta.example.com/product1\"")
+	product2 := identity("data_hive = \"http\"\nmeta_hive = \"server\"\n[http]\nhost = \"https://cdn.example.com/product2\"\n[server]\naddress = \"https://meta.example.com/product2\"")
+	product1Again := identity("data_hive = \"HTTP\"\nmeta_hive = \"server\"\n[http]\nhost = \"https://cdn.example.com/product1\"\nretries = 5\n[server]\naddress = \"https://meta.example.com/product1\"")
+
+	if product1 == product2 {
+		t.Error("different hives share the cache")
+	}
+	if product1 != product1Again {
+		t.Error("same hives don't share the cache")
+	}
+}
+
+func TestResumeCommit(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+	cfg.parallelism = 1
+
+	local := cfg.dataHive
+	failing := &testDataHive{DataHive: local, failAfter: 1}
+	cfg.dataHive = failing
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err == nil {
+		t.Fatal("expected commit to fail")
+	}
+
+	// Resume, the first upload is in the journal
+	counting := &testDataHive{DataHive: local, failAfter: -1}
+	cfg.dataHive = counting
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3 chunks, 1 uploaded before the failure: 2 chunks plus manifest
+	if counting.uploads != 3 {
+		t.Errorf("expected 3 uploads, got %v", counting.uploads)
+	}
+
+	// Same content for another tag, all chunks are present already
+	counting.uploads = 0
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counting.uploads != 1 {
+		t.Errorf("expected only the manifest to be uploaded, got %v uploads", counting.uploads)
+	}
+
+	// Old files might be deleted by gc any moment, they are touched instead of uploaded again
+	old := time.Now().Add(-2 * maxUntouchedAge)
+	files, err := local.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		os.Chtimes(filepath.Join("local_db", file.Name), old, old)
+	}
+	counting.uploads = 0
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "third")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counting.uploads != 1 {
+		t.Errorf("expected only the manifest to be uploaded, got %v uploads", counting.uploads)
+	}
+	for _, file := range files {
+		info, err := local.Stat(file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if chunkNamePattern.MatchString(file.Name) && !touched(info.ModTime) {
+			t.Errorf("%v not touched", file.Name)
+		}
+	}
+
+	err = restore(cfg, "other", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+}
+
+func TestGarbageCollection(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the first version, its manifest and unique chunks become unreachable
+	err = version(cfg, "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend everything is old, except for one file of a commit in progress
+	old := time.Now().Add(-48 * time.Hour)
+	files, err := cfg.dataHive.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		os.Chtimes(filepath.Join("local_db", file.Name), old, old)
+	}
+
+	inProgress := strings.Repeat("ab", 32) + ".zst"
+	os.WriteFile(filepath.Join("local_db", inProgress), []byte("in progress"), 0666)
+
+	// Shorter than the age of files commits reuse
+	err = gc(cfg, maxUntouchedAge, true)
+	if err == nil {
+		t.Error("expected short grace period to be rejected")
+	}
+
+	err = gc(cfg, 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesAfterDryRun, err := cfg.dataHive.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesAfterDryRun) != len(files)+1 {
+		t.Errorf("dry run deleted files")
+	}
+
+	err = gc(cfg, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filesAfterGc, err := cfg.dataHive.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filesAfterGc) >= len(filesAfterDryRun) {
+		t.Errorf("nothing deleted")
+	}
+	if _, err := cfg.dataHive.Stat(inProgress); err != nil {
+		t.Errorf("file within grace period deleted: %v", err)
+	}
+	if _, err := os.Stat("local_db/test.db"); err != nil {
+		t.Errorf("unrelated file deleted: %v", err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+}
+
+func TestVerify(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyHive(cfg, "latest", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var chunks []string
+	for _, entry := range staged.Changed {
+		chunks = append(chunks, entry.Blob().ChunkNames()...)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected at least 2 chunks, got %v", len(chunks))
+	}
+
+	// Quick only notices missing chunks
+	os.WriteFile(filepath.Join("local_db", chunks[0]), []byte("garbage"), 0666)
+
+	err = verifyHive(cfg, "", true, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = verifyHive(cfg, "latest", false, false)
+	if err == nil {
+		t.Fatal("expected verify to detect the corrupt chunk")
+	}
+
+	os.Remove(filepath.Join("local_db", chunks[1]))
+
+	err = verifyHive(cfg, "", true, true)
+	if err == nil {
+		t.Fatal("expected verify to detect the missing chunk")
+	}
+}
+
+func TestSquash(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = squash(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreChain, err := findRestoreChain(cfg.metaHive, tag.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restoreChain) != 1 {
+		t.Errorf("expected a single snapshot, got %v entries", len(restoreChain))
+	}
+
+	// Files deleted by the squashed patch are still removed
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+	if _, err := os.Stat("out/file2"); !os.IsNotExist(err) {
+		t.Error("deleted file still exists")
+	}
+
+	// Commit squashes automatically
+	cfg.squashEvery = 1
+
+	err = patch(cfg, "latest", "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err = cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restoreChain, err = findRestoreChain(cfg.metaHive, tag.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restoreChain) != 1 {
+		t.Errorf("expected commit to squash, got %v entries", len(restoreChain))
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// A failed squash doesn't fail the published commit
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	local := cfg.dataHive
+	cfg.dataHive = &testDataHive{DataHive: local, failAfter: -1, failUpload: func(fileName string) bool {
+		return isManifest(fileName) && fileName != staged.ID.String()+".json"
+	}}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.dataHive = local
+
+	tag, err = cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Id != staged.ID {
+		t.Error("commit not published")
+	}
+	if _, err := os.Stat(".staging/staged.json"); !os.IsNotExist(err) {
+		t.Error("staged patch not removed")
+	}
+}
+
+func TestCommitConflict(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Someone else publishes on the same tag in the meantime
+	head, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID := uuid.New()
+	err = cfg.metaHive.Publish(otherID, head.Id, "latest", head.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if !errors.Is(err, meta_hives.ErrTagConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Id != otherID {
+		t.Error("conflicting commit moved the tag")
+	}
+}
+
+func TestSignedManifests(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unsigned manifests are refused
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "unsigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.signingKey = privateKey
+	cfg.publicKey = publicKey
+
+	err = restore(cfg, "unsigned", "out", restoreOptions{})
+	if err == nil {
+		t.Fatal("expected unsigned manifest to be refused")
+	}
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+
+	// Tampered manifests are refused. Restore into a fresh directory, "out" is at the head already.
+	defer os.RemoveAll("out_fresh")
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestPath := filepath.Join("local_db", tag.Id.String()+".json")
+	manifest := readPatchFile(manifestPath)
+	manifest.Changed[0].Hash = strings.Repeat("0", 64)
+	if err := writeToJsonFile(manifest, manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out_fresh", restoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "invalid signature") {
+		t.Fatalf("expected invalid signature, got %v", err)
+	}
+
+	// So are validly signed manifests stored under the wrong name
+	unsignedTag, err := cfg.metaHive.FindTagByName("unsigned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherManifest := readPatchFile(filepath.Join("local_db", unsignedTag.Id.String()+".json"))
+	if err := signPatchFile(&otherManifest, privateKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeToJsonFile(otherManifest, manifestPath); err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out_fresh", restoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "doesn't belong") {
+		t.Fatalf("expected foreign manifest to be refused, got %v", err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+}
+
+func TestFileMetadata(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs unix file modes and symlinks")
+	}
+
+	cfg := newTestConfig(t)
+	cfg.preserveMtime = true
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src/sub", 0777)
+	defer os.RemoveAll("out_src")
+
+	writeFiles := map[string]string{"run.sh": "#!/bin/sh", "lib.so.1": "library", "notes": "notes", "sub/file": "file"}
+	for name, content := range writeFiles {
+		if err := os.WriteFile(filepath.Join("out_src", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chmod("out_src/run.sh", 0755)
+	os.Symlink("lib.so.1", "out_src/lib.so")
+	os.Mkdir("out_src/empty", 0700)
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	os.Chtimes("out_src/run.sh", modTime, modTime)
+
+	err := version(cfg, "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+
+	checkMode := func(name string, mode fs.FileMode) {
+		info, err := os.Lstat(filepath.Join("out", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != mode {
+			t.Errorf("%v: expected mode %v, got %v", name, mode, info.Mode())
+		}
+	}
+	checkMode("run.sh", 0755)
+	checkMode("lib.so.1", 0644)
+	checkMode("empty", fs.ModeDir|0700)
+
+	if target, err := os.Readlink("out/lib.so"); err != nil || target != "lib.so.1" {
+		t.Errorf("expected symlink to lib.so.1, got %v (%v)", target, err)
+	}
+	if info, err := os.Stat("out/run.sh"); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time not restored")
+	}
+
+	// Mode change only, directory replaced by a file and the other way around
+	os.Chmod("out_src/run.sh", 0700)
+	os.RemoveAll("out_src/sub")
+	os.WriteFile("out_src/sub", []byte("now a file"), 0644)
+	os.Remove("out_src/notes")
+	os.MkdirAll("out_src/notes", 0777)
+	os.WriteFile("out_src/notes/a", []byte("a"), 0644)
+
+	err = patch(cfg, "latest", "out_src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	for _, entry := range staged.Changed {
+		if entry.FileName == "run.sh" && (entry.Mode != 0700 || entry.Delta != nil) {
+			t.Errorf("unexpected entry for mode change %+v", entry)
+		}
+	}
+	if len(staged.Deleted) != 1 || staged.Deleted[0].FileName != "sub/file" {
+		t.Errorf("unexpected deletions %+v", staged.Deleted)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "out_src")
+	checkMode("run.sh", 0700)
+	checkMode("sub", 0644)
+	checkMode("notes", fs.ModeDir|0755)
+
+	// The previous tree is untouched
+	if info, err := os.Stat(filepath.Join(restorePrevPath(mustAbs(t, "out")), "run.sh")); err != nil || info.Mode() != 0755 {
+		t.Errorf("previous tree modified")
+	}
+}
+
+func TestIgnoreRules(t *testing.T) {
+	rules, err := newIgnoreRules([]string{"*.pdb", "/build/", "docs/**/*.tmp", "cache/**"}, []string{"keep.pdb"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		fileName string
+		isDir    bool
+		ignored  bool
+	}{
+		{"app.pdb", false, true},
+		{"sub/app.pdb", false, true},
+		{"keep.pdb", false, false},
+		{"sub/keep.pdb", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"sub/build", true, false},
+		{"docs/a.tmp", false, true},
+		{"docs/a/b/c.tmp", false, true},
+		{"a.tmp", false, false},
+		{"cache/x/y", false, true},
+		{"cache", true, false},
+		{"app.exe", false, false},
+	}
+	for _, c := range cases {
+		if rules.ignored(filepath.FromSlash(c.fileName), c.isDir) != c.ignored {
+			t.Errorf("%v (dir %v): expected ignored %v", c.fileName, c.isDir, c.ignored)
+		}
+	}
+}
+
+func TestIgnoredFiles(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	os.RemoveAll("out_src")
+	os.MkdirAll("out_src/sub", 0777)
+	os.MkdirAll("out_src/logs", 0777)
+	defer os.RemoveAll("out_src")
+
+	files := map[string]string{
+		"app.exe":               "app",
+		"app.pdb":               "symbols",
+		"debug.log":             "log",
+		"important.log":         "important",
+		"logs/today":            "log",
+		"sub/local.cfg":         "local config",
+		"sub/shared.cfg":        "shared config",
+		".transportignore":      "# build output\n*.log\n!important.log\nlogs/\n",
+		"sub/" + ignoreFileName: "local.cfg\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join("out_src", name), []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The first version contains everything but the ignored files
+	rules, err := newIgnoreRules([]string{"*.pdb"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = version(cfg, "out_src", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := readPatchFile(".staging/staged.json")
+	var fileNames []string
+	for _, entry := range staged.Changed {
+		fileNames = append(fileNames, filepath.ToSlash(entry.FileName))
+	}
+	sort.Strings(fileNames)
+	expected := []string{"app.exe", "important.log", "sub", "sub/shared.cfg"}
+	if strings.Join(fileNames, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, fileNames)
+	}
+
+	// Files in the previous version that are ignored now aren't deleted
+	err = version(cfg, "out_src", &ignoreRules{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	os.Remove("out_src/app.pdb")
+	os.RemoveAll("out_src/logs")
+	os.WriteFile("out_src/app.exe", []byte("app 2"), 0666)
+
+	err = patch(cfg, "latest", "out_src", rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged = readPatchFile(".staging/staged.json")
+	if len(staged.Changed) != 1 || staged.Changed[0].FileName != "app.exe" {
+		t.Errorf("unexpected changes %+v", staged.Changed)
+	}
+	if len(staged.Deleted) != 0 {
+		t.Errorf("unexpected deletions %+v", staged.Deleted)
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	keys, err := parseEncryptionKeys("", map[string]string{"1": base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, size := range []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, 3 * encryptionSegmentSize} {
+		content := make([]byte, size)
+		rand.New(rand.NewSource(int64(size))).Read(content)
+
+		encrypted := new(bytes.Buffer)
+		if err := keys.encrypt(encrypted, bytes.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+		if keys.plainSize(int64(encrypted.Len())) != int64(size) {
+			t.Errorf("%v: wrong plain size %v", size, keys.plainSize(int64(encrypted.Len())))
+		}
+
+		decrypted := new(bytes.Buffer)
+		if err := keys.decrypt(decrypted, bytes.NewReader(encrypted.Bytes())); err != nil {
+			t.Fatalf("%v: %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), content) {
+			t.Errorf("%v: content differs", size)
+		}
+
+		// Truncation and modification are detected
+		truncated := encrypted.Bytes()[:encrypted.Len()-1]
+		if err := keys.decrypt(io.Discard, bytes.NewReader(truncated)); err == nil {
+			t.Errorf("%v: truncation not detected", size)
+		}
+		if size > encryptionSegmentSize {
+			cut := encrypted.Bytes()[:encrypted.Len()-(size%encryptionSegmentSize+16)]
+			if err := keys.decrypt(io.Discard, bytes.NewReader(cut)); err == nil {
+				t.Errorf("%v: missing segment not detected", size)
+			}
+		}
+
+		modified := append([]byte{}, encrypted.Bytes()...)
+		modified[len(modified)-1] ^= 1
+		if err := keys.decrypt(io.Discard, bytes.NewReader(modified)); err == nil {
+			t.Errorf("%v: modification not detected", size)
+		}
+	}
+}
+
+func TestEnableEncryption(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encryption, err := parseEncryptionKeys("1", map[string]string{"1": base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.RemoveAll("local_cache")
+	defer os.RemoveAll("local_cache")
+	cache, err := newChunkCache("local_cache", 1024*1024*1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &testDataHive{DataHive: cfg.dataHive, failAfter: -1}
+	cfg.dataHive = &encryptedDataHive{inner: &cachedDataHive{remote: counting, cache: cache}, keys: encryption}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "not encrypted") {
+		t.Fatalf("expected unencrypted files to be rejected, got %v", err)
+	}
+
+	// Migration
+	encryption.allowUnencrypted = true
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// Unencrypted files are uploaded again encrypted. Their key IDs are read from the hive, not
+	// through the cache.
+	cachedChunks := func() []string {
+		var chunks []string
+		files, _ := os.ReadDir("local_cache/blobs")
+		for _, file := range files {
+			if chunkNamePattern.MatchString(file.Name()) {
+				chunks = append(chunks, file.Name())
+			}
+		}
+		return chunks
+	}
+	for _, chunk := range cachedChunks() {
+		os.Remove(filepath.Join("local_cache/blobs", chunk))
+	}
+	counting.uploads = 0
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counting.uploads != 4 {
+		t.Errorf("expected 3 chunks plus manifest to be uploaded, got %v uploads", counting.uploads)
+	}
+	if cached := cachedChunks(); len(cached) != 0 {
+		t.Errorf("key ID reads filled the cache: %v", cached)
+	}
+
+	// With a single key, every file uses it and no key IDs are read
+	encryption.allowUnencrypted = false
+	counting.downloads = 0
+
+	err = version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counting.downloads != 0 {
+		t.Errorf("expected no downloads, got %v", counting.downloads)
+	}
+
+	os.RemoveAll("out")
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+}
+
+func TestEncryptedRestore(t *testing.T) {
+	cfg := newTestConfig(t)
+	defer cfg.dataHive.Close()
+
+	key1 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	key2 := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32))
+
+	localHive := cfg.dataHive
+	useKeys := func(current string, keys map[string]string) {
+		encryption, err := parseEncryptionKeys(current, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.dataHive = &encryptedDataHive{inner: localHive, keys: encryption}
+	}
+
+	useKeys("1", map[string]string{"1": key1})
+
+	err := version(cfg, "test_data/base1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing readable ends up in the data hive
+	tag, err := cfg.metaHive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := os.ReadFile(filepath.Join("local_db", tag.Id.String()+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(manifest, []byte(encryptionMagic)) || bytes.Contains(manifest, []byte("FileName")) {
+		t.Error("manifest not encrypted")
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/base1")
+
+	// Rotate keys, old files stay readable
+	useKeys("2", map[string]string{"1": key1, "2": key2})
+
+	err = patch(cfg, "latest", "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+
+	// A new version uploads everything again with the new key, the old key isn't needed anymore
+	err = version(cfg, "test_data/patch1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = commit(cfg, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys("2", map[string]string{"2": key2})
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compareDirs(t, "out", "test_data/patch1")
+
+	// Without the right key nothing can be restored
+	useKeys("1", map[string]string{"1": key1})
+	os.RemoveAll("out")
+
+	err = restore(cfg, "latest", "out", restoreOptions{})
+	if err == nil || !strings.Contains(err.Error(), "unknown key") {
+		t.Fatalf("expected unknown key, got %v", err)
+	}
+}
+
+// testDataHive counts uploads and fails after failAfter uploads (never if negative).
+type testDataHive struct {
+	DataHive
+	failAfter int
+	// Optional, fails uploads of the files it returns true for
+	failUpload func(fileName string) bool
+
+	// Guards the counters, uploads and downloads run in parallel
+	mutex     sync.Mutex
+	uploads   int
+	downloads int
+}
+
+func (p *testDataHive) DownloadFile(fileName string, w io.Writer) error {
+	p.mutex.Lock()
+	p.downloads++
+	p.mutex.Unlock()
+
+	return p.DataHive.DownloadFile(fileName, w)
+}
+
+func (p *testDataHive) UploadFile(fileName string, r io.Reader) error {
+	p.mutex.Lock()
+	if p.failAfter >= 0 && p.uploads >= p.failAfter {
+		p.mutex.Unlock()
+		return errors.New("injected failure")
+	}
+	if p.failUpload != nil && p.failUpload(fileName) {
+		p.mutex.Unlock()
+		return errors.New("injected failure")
+	}
+	p.uploads++
+	p.mutex.Unlock()
+
+	return p.DataHive.UploadFile(fileName, r)
+}
+
+func mustAbs(t *testing.T, path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return abs
+}
+
+func newTestConfig(t *testing.T) *Config {
+	os.RemoveAll("local_db")
+	os.MkdirAll("local_db", 0777)
+
+	os.RemoveAll("out")
+	os.RemoveAll(restorePrevPath(mustAbs(t, "out")))
+	os.RemoveAll(rollbackTmpPath(mustAbs(t, "out")))
+
+	metaHive, err := meta_hives.NewSqlite("local_db/test.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataHive := data_hives.NewLocal("local_db")
+	return NewConfig(metaHive, dataHive)
+}
+
 func compareDirs(t *testing.T, dir string, dir2 string) {
 	entries, err := os.ReadDir(dir)
 	if err != nil {
@@ -99,7 +1919,7 @@ func compareDirs(t *testing.T, dir string, dir2 string) {
 				continue
 			}
 
-			content, _ := os.ReadFile(entry.Name())
+			content, _ := os.ReadFile(filepath.Join(dir, entry.Name()))
 			foo[entry.Name()] = sha256.Sum256(content)
 		}
 	}
@@ -116,7 +1936,7 @@ func compareDirs(t *testing.T, dir string, dir2 string) {
 				continue
 			}
 
-			content, _ := os.ReadFile(entry.Name())
+			content, _ := os.ReadFile(filepath.Join(dir2, entry.Name()))
 
 			if sha256.Sum256(content) != foo[entry.Name()] {
 				t.Errorf("File %v different", entry.Name())
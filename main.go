@@ -2,18 +2,24 @@ package main
 
 import (
 	"log"
+	"os"
+	"time"
 
 	"github.com/alecthomas/kong"
 )
 
 var CLI struct {
 	Version struct {
-		Directory string `arg:""`
+		Directory string   `arg:""`
+		Exclude   []string `help:"Ignore paths matching the pattern, in addition to .transportignore files."`
+		Include   []string `help:"Don't ignore paths matching the pattern."`
 	} `cmd:"" help:"Create version."`
 
 	Patch struct {
-		Tag       string `arg:""`
-		Directory string `arg:""`
+		Tag       string   `arg:""`
+		Directory string   `arg:""`
+		Exclude   []string `help:"Ignore paths matching the pattern, in addition to .transportignore files."`
+		Include   []string `help:"Don't ignore paths matching the pattern."`
 	} `cmd:"" help:"Create patch relative to latest published version/patch."`
 
 	Commit struct {
@@ -23,10 +29,52 @@ var CLI struct {
 	Restore struct {
 		Tag       string `arg:""`
 		Directory string `arg:""`
+		Offline   bool   `help:"Restore from the local cache only."`
+		Clean     bool   `help:"Remove files and directories not in the manifest, except protected ones."`
 	} `cmd:"" help:"Restore the latest published version/release into directory."`
 
+	Rollback struct {
+		Directory string `arg:""`
+	} `cmd:"" help:"Bring back the directory contents from before the last restore."`
+
 	Tags struct {
 	} `cmd:"" help:"Print published tags."`
+
+	Squash struct {
+		Tag string `arg:""`
+	} `cmd:"" help:"Replace the restore chain of the tag with a single snapshot."`
+
+	Status struct {
+		Tag       string `arg:""`
+		Directory string `arg:""`
+		Json      bool   `help:"Print the differences as JSON."`
+	} `cmd:"" help:"Compare directory to the latest published version/patch. Exits with 1 if they differ, 2 on errors."`
+
+	Verify struct {
+		Tag   string `arg:"" optional:""`
+		All   bool   `help:"Verify every tag."`
+		Quick bool   `help:"Only check that every chunk exists, don't download."`
+	} `cmd:"" help:"Check that all objects the tag needs are intact in the data hive."`
+
+	ServeMeta struct {
+		Database string `arg:"" help:"SQLite database file."`
+		Listen   string `default:":8080" help:"Address to listen on."`
+		Token    string `env:"TRANSPORT_META_TOKEN" help:"Token required for publishing. Without, the meta hive is read-only."`
+	} `cmd:"" help:"Serve a SQLite meta hive over HTTP."`
+
+	ServeData struct {
+		Directory string `arg:""`
+		Listen    string `default:":8081" help:"Address to listen on."`
+	} `cmd:"" help:"Serve a local data hive directory over HTTP."`
+
+	Keygen struct {
+		Out string `default:"transport.key" help:"File the private key is written to."`
+	} `cmd:"" help:"Create a key pair for signing manifests."`
+
+	Gc struct {
+		DryRun     bool `help:"Only print what would be deleted."`
+		GraceHours int  `default:"24" help:"Keep unreferenced files younger than this many hours."`
+	} `cmd:"" help:"Delete data hive files not reachable from any tag."`
 }
 
 func main() {
@@ -40,7 +88,12 @@ func main() {
 		}
 		defer cfg.dataHive.Close()
 
-		err = version(cfg, CLI.Version.Directory)
+		rules, err := newIgnoreRules(CLI.Version.Exclude, CLI.Version.Include)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = version(cfg, CLI.Version.Directory, rules)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -53,7 +106,12 @@ func main() {
 		}
 		defer cfg.dataHive.Close()
 
-		err = patch(cfg, CLI.Patch.Tag, CLI.Patch.Directory)
+		rules, err := newIgnoreRules(CLI.Patch.Exclude, CLI.Patch.Include)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		err = patch(cfg, CLI.Patch.Tag, CLI.Patch.Directory, rules)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -72,14 +130,25 @@ func main() {
 		}
 
 	case "restore <tag> <directory>":
-		cfg, err := readConfig("release.toml")
+		readConfigFunc := readConfig
+		if CLI.Restore.Offline {
+			readConfigFunc = readOfflineConfig
+		}
+
+		cfg, err := readConfigFunc("release.toml")
 		if err != nil {
 			log.Fatalf("Configuration invalid: %v", err)
 			return
 		}
 		defer cfg.dataHive.Close()
 
-		err = restore(cfg, CLI.Restore.Tag, CLI.Restore.Directory)
+		err = restore(cfg, CLI.Restore.Tag, CLI.Restore.Directory, restoreOptions{clean: CLI.Restore.Clean})
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "rollback <directory>":
+		err := rollback(CLI.Rollback.Directory)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -97,6 +166,85 @@ func main() {
 			log.Fatal(err)
 		}
 
+	case "status <tag> <directory>":
+		// Like diff: 1 if the directory differs, 2 if the comparison failed
+		cfg, err := readConfig("release.toml")
+		if err != nil {
+			log.Printf("Configuration invalid: %v", err)
+			os.Exit(2)
+		}
+
+		dirty, err := status(cfg, CLI.Status.Tag, CLI.Status.Directory, CLI.Status.Json)
+		cfg.dataHive.Close()
+		if err != nil {
+			log.Print(err)
+			os.Exit(2)
+		}
+		if dirty {
+			os.Exit(1)
+		}
+
+	case "squash <tag>":
+		cfg, err := readConfig("production.toml")
+		if err != nil {
+			log.Fatalf("Configuration invalid: %v", err)
+			return
+		}
+		defer cfg.dataHive.Close()
+
+		err = squash(cfg, CLI.Squash.Tag)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "verify", "verify <tag>":
+		if (CLI.Verify.Tag == "") == !CLI.Verify.All {
+			log.Fatal("Either a tag or --all required")
+		}
+
+		cfg, err := readUncachedConfig("production.toml")
+		if err != nil {
+			log.Fatalf("Configuration invalid: %v", err)
+			return
+		}
+		defer cfg.dataHive.Close()
+
+		err = verifyHive(cfg, CLI.Verify.Tag, CLI.Verify.All, CLI.Verify.Quick)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "serve-meta <database>":
+		err := serveMeta(CLI.ServeMeta.Database, CLI.ServeMeta.Listen, CLI.ServeMeta.Token)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "serve-data <directory>":
+		err := serveData(CLI.ServeData.Directory, CLI.ServeData.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "keygen":
+		err := keygen(CLI.Keygen.Out)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "gc":
+		cfg, err := readConfig("production.toml")
+		if err != nil {
+			log.Fatalf("Configuration invalid: %v", err)
+			return
+		}
+		defer cfg.dataHive.Close()
+
+		err = gc(cfg, time.Duration(CLI.Gc.GraceHours)*time.Hour, CLI.Gc.DryRun)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 	default:
 		panic(ctx.Command())
 	}
@@ -8,10 +8,12 @@ import (
 type MetaHive interface {
 	Tags() ([]meta_hives.Tag, error)
 	FindTagByName(name string) (*meta_hives.Tag, error)
-	UpdateTag(name string, newId uuid.UUID) error
 
 	FindEntry(id uuid.UUID) (uuid.UUID, error)
-	AddEntry(id uuid.UUID, baseId uuid.UUID) error
+
+	// Publish atomically adds the entry and moves the tag to it. Fails with
+	// meta_hives.ErrTagConflict if the tag doesn't point at expectedHead (uuid.Nil: tag doesn't exist).
+	Publish(entryId uuid.UUID, baseId uuid.UUID, tagName string, expectedHead uuid.UUID) error
 
 	Close()
 }
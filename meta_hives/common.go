@@ -1,6 +1,13 @@
 package meta_hives
 
-import "github.com/google/uuid"
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ErrTagConflict is returned by Publish if the tag was moved by someone else.
+var ErrTagConflict = errors.New("tag conflict")
 
 type Tag struct {
 	Name string
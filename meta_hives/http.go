@@ -0,0 +1,128 @@
+package meta_hives
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// HttpMetaHive is the client of MetaServer.
+type HttpMetaHive struct {
+	address string
+	token   string
+	client  *http.Client
+}
+
+func NewHttp(address string, token string, timeout time.Duration) (*HttpMetaHive, error) {
+	if _, err := url.Parse(address); err != nil {
+		return nil, err
+	}
+
+	return &HttpMetaHive{
+		address: strings.TrimSuffix(address, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (p *HttpMetaHive) Tags() ([]Tag, error) {
+	var tags []Tag
+	_, err := p.do(http.MethodGet, "/tags", nil, &tags)
+	if err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+func (p *HttpMetaHive) FindTagByName(name string) (*Tag, error) {
+	var tag Tag
+	found, err := p.do(http.MethodGet, "/tags/"+url.PathEscape(name), nil, &tag)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &tag, nil
+}
+
+func (p *HttpMetaHive) FindEntry(id uuid.UUID) (uuid.UUID, error) {
+	var entry Entry
+	_, err := p.do(http.MethodGet, "/entries/"+id.String(), nil, &entry)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	return entry.BaseId, nil
+}
+
+func (p *HttpMetaHive) Publish(entryId uuid.UUID, baseId uuid.UUID, tagName string, expectedHead uuid.UUID) error {
+	req := publishRequest{
+		Id:           entryId,
+		BaseId:       baseId,
+		ExpectedHead: expectedHead,
+	}
+
+	var tag Tag
+	_, err := p.do(http.MethodPut, "/tags/"+url.PathEscape(tagName), &req, &tag)
+	return err
+}
+
+func (p *HttpMetaHive) Close() {
+	p.client.CloseIdleConnections()
+}
+
+// do sends the request and decodes the response into result. Returns false if the resource
+// doesn't exist.
+func (p *HttpMetaHive) do(method string, path string, body interface{}, result interface{}) (bool, error) {
+	var bodyReader io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		bodyReader = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, p.address+path, bodyReader)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, json.NewDecoder(resp.Body).Decode(result)
+
+	case http.StatusNotFound:
+		return false, nil
+
+	case http.StatusConflict:
+		return false, fmt.Errorf("%w: %v", ErrTagConflict, readError(resp))
+
+	default:
+		return false, fmt.Errorf("%v %v: %v: %v", method, path, resp.Status, readError(resp))
+	}
+}
+
+func readError(resp *http.Response) string {
+	var errResp errorResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxRequestSize)).Decode(&errResp); err != nil {
+		return "invalid error response"
+	}
+	return errResp.Error
+}
@@ -0,0 +1,203 @@
+package meta_hives
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestServer(t *testing.T, token string) *httptest.Server {
+	store, err := NewSqlite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+
+	server := httptest.NewServer(NewMetaServer(store, token))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHttpMetaHive(t *testing.T) {
+	server := newTestServer(t, "secret")
+
+	hive, err := NewHttp(server.URL, "secret", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hive.Close()
+
+	tags, err := hive.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 0 {
+		t.Errorf("expected no tags, got %v", tags)
+	}
+
+	tag, err := hive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag != nil {
+		t.Errorf("expected unknown tag, got %v", tag)
+	}
+
+	// Tag names are escaped
+	const tagName = "release/1.0 beta"
+	versionID := uuid.New()
+	patchID := uuid.New()
+	if err := hive.Publish(versionID, uuid.Nil, tagName, uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := hive.Publish(patchID, versionID, tagName, versionID); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err = hive.FindTagByName(tagName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag == nil || tag.Name != tagName || tag.Id != patchID {
+		t.Errorf("unexpected tag %v", tag)
+	}
+
+	tags, err = hive.Tags()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tags) != 1 || tags[0].Name != tagName {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	baseID, err := hive.FindEntry(patchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseID != versionID {
+		t.Errorf("expected base %v, got %v", versionID, baseID)
+	}
+
+	baseID, err = hive.FindEntry(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseID != uuid.Nil {
+		t.Errorf("expected no base for unknown entry, got %v", baseID)
+	}
+
+	err = hive.Publish(uuid.New(), versionID, tagName, versionID)
+	if !errors.Is(err, ErrTagConflict) {
+		t.Errorf("expected conflict, got %v", err)
+	}
+
+	err = hive.Publish(patchID, versionID, tagName, patchID)
+	if err == nil || errors.Is(err, ErrTagConflict) {
+		t.Errorf("expected existing entry to be refused, got %v", err)
+	}
+}
+
+func TestHttpMetaHiveAuthentication(t *testing.T) {
+	server := newTestServer(t, "secret")
+
+	for _, token := range []string{"", "wrong"} {
+		hive, err := NewHttp(server.URL, token, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Reads are public
+		if _, err := hive.Tags(); err != nil {
+			t.Errorf("token '%v': %v", token, err)
+		}
+
+		err = hive.Publish(uuid.New(), uuid.Nil, "latest", uuid.Nil)
+		if err == nil || !strings.Contains(err.Error(), "401") {
+			t.Errorf("token '%v': expected 401, got %v", token, err)
+		}
+
+		hive.Close()
+	}
+
+	// Without server token nothing can be published
+	readOnlyServer := newTestServer(t, "")
+
+	hive, err := NewHttp(readOnlyServer.URL, "", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hive.Close()
+
+	if err := hive.Publish(uuid.New(), uuid.Nil, "latest", uuid.Nil); err == nil {
+		t.Error("expected publish to fail")
+	}
+}
+
+func TestMetaServerErrors(t *testing.T) {
+	server := newTestServer(t, "secret")
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{http.MethodPost, "/tags", "", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "/tags/latest", "", http.StatusMethodNotAllowed},
+		{http.MethodPut, "/tags/latest", "{", http.StatusBadRequest},
+		{http.MethodPut, "/tags/latest", "{}", http.StatusBadRequest},
+		{http.MethodGet, "/entries/foo", "", http.StatusBadRequest},
+		{http.MethodGet, "/foo", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != test.status {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.path, test.status, resp.StatusCode)
+		}
+		if resp.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%v %v: expected JSON error", test.method, test.path)
+		}
+	}
+}
+
+func TestMetaServerUnauthorized(t *testing.T) {
+	server := newTestServer(t, "secret")
+
+	for _, authorization := range []string{"", "secret", "Bearer wrong", "Basic secret"} {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/tags/latest", strings.NewReader("{}"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("'%v': expected %v, got %v", authorization, http.StatusUnauthorized, resp.StatusCode)
+		}
+	}
+}
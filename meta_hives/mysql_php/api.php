@@ -40,15 +40,6 @@ else if ($_GET["action"] == "find_tag_by_name") {
         echo $row["id"];
     }
 }
-else if ($_GET["action"] == "update_tag") {
-    $safe_name =  $conn->real_escape_string($_GET['name']);
-    $safe_new_id =  $conn->real_escape_string($_GET['new_id']);
-
-    $result = $conn->query("INSERT INTO tags (name, id) VALUES ('$safe_name','$safe_new_id') ON DUPLICATE KEY UPDATE id='$safe_new_id'");
-    if ($result == false) {
-        die($conn->error);
-    }
-}
 else if ($_GET["action"] == "find_entry") {
     $safe_id =  $conn->real_escape_string($_GET['id']);
 
@@ -62,14 +53,49 @@ else if ($_GET["action"] == "find_entry") {
         echo $row["base_id"];
     }
 }
-else if ($_GET["action"] == "add_entry") {
+else if ($_GET["action"] == "publish") {
     $safe_id =  $conn->real_escape_string($_GET['id']);
     $safe_base_id =  $conn->real_escape_string($_GET['base_id']);
+    $safe_name =  $conn->real_escape_string($_GET['name']);
+    $expected_head = $_GET['expected_head'];
+
+    // Entry and tag change together, and only if nobody moved the tag in between
+    $conn->begin_transaction();
+
+    $result = $conn->query("SELECT id FROM tags WHERE name='$safe_name' FOR UPDATE");
+    if ($result == false) {
+        $conn->rollback();
+        die($conn->error);
+    }
+
+    $head = "00000000-0000-0000-0000-000000000000";
+    if ($result->num_rows > 0) {
+        $row = $result->fetch_assoc();
+        $head = $row["id"];
+    }
+
+    if ($head != $expected_head) {
+        $conn->rollback();
+        http_response_code(409);
+        die($head);
+    }
 
     $result = $conn->query("INSERT INTO entries (id, base_id) VALUES ('$safe_id','$safe_base_id')");
     if ($result == false) {
+        $conn->rollback();
+        die($conn->error);
+    }
+
+    $result = $conn->query("INSERT INTO tags (name, id) VALUES ('$safe_name','$safe_id') ON DUPLICATE KEY UPDATE id='$safe_id'");
+    if ($result == false) {
+        $conn->rollback();
+        die($conn->error);
+    }
+
+    if (!$conn->commit()) {
         die($conn->error);
     }
+    echo "ok";
 }
 
 ?>
\ No newline at end of file
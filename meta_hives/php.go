@@ -2,8 +2,10 @@ package meta_hives
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/google/uuid"
 )
@@ -64,11 +66,6 @@ func (p *PhpMetaHive) FindTagByName(name string) (*Tag, error) {
 	}, nil
 }
 
-func (p *PhpMetaHive) UpdateTag(name string, newId uuid.UUID) error {
-	_, err := http.Get(p.address + "/api?action=update_tag&name=" + name + "&new_id=" + newId.String())
-	return err
-}
-
 func (p *PhpMetaHive) FindEntry(id uuid.UUID) (uuid.UUID, error) {
 	resp, err := http.Get(p.address + "/api?action=find_entry&id=" + id.String())
 	if err != nil {
@@ -92,9 +89,27 @@ func (p *PhpMetaHive) FindEntry(id uuid.UUID) (uuid.UUID, error) {
 	return base_id, nil
 }
 
-func (p *PhpMetaHive) AddEntry(id uuid.UUID, baseId uuid.UUID) error {
-	_, err := http.Get(p.address + "/api?action=add_entry&id=" + id.String() + "&base_id=" + baseId.String())
-	return err
+func (p *PhpMetaHive) Publish(entryId uuid.UUID, baseId uuid.UUID, tagName string, expectedHead uuid.UUID) error {
+	resp, err := http.Get(p.address + "/api?action=publish&id=" + entryId.String() + "&base_id=" + baseId.String() +
+		"&name=" + url.QueryEscape(tagName) + "&expected_head=" + expectedHead.String())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusConflict {
+		return fmt.Errorf("%w: '%v' points at %s, expected %v", ErrTagConflict, tagName, respBytes, expectedHead)
+	}
+	if resp.StatusCode != http.StatusOK || string(respBytes) != "ok" {
+		return fmt.Errorf("publish failed: %s", respBytes)
+	}
+
+	return nil
 }
 
 func (p *PhpMetaHive) Close() {
@@ -0,0 +1,204 @@
+package meta_hives
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// JSON REST API served by MetaServer and used by HttpMetaHive:
+//
+//	GET /tags          all tags
+//	GET /tags/{name}   a single tag, 404 if unknown
+//	PUT /tags/{name}   publish an entry and move the tag to it (publishRequest), 409 on conflict
+//	GET /entries/{id}  an entry and its base, 404 if unknown
+//
+// Reads are public, PUT requires "Authorization: Bearer <token>". Errors are sent as errorResponse.
+
+type Entry struct {
+	Id     uuid.UUID
+	BaseId uuid.UUID
+}
+
+type publishRequest struct {
+	Id           uuid.UUID
+	BaseId       uuid.UUID
+	ExpectedHead uuid.UUID
+}
+
+type errorResponse struct {
+	Error string
+}
+
+const maxRequestSize = 64 * 1024
+
+type MetaServer struct {
+	store *SqliteMetaHive
+	token string
+}
+
+// NewMetaServer serves the store. Without token all mutations are refused.
+func NewMetaServer(store *SqliteMetaHive, token string) *MetaServer {
+	return &MetaServer{
+		store: store,
+		token: token,
+	}
+}
+
+func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/tags":
+		s.serveTags(w, r)
+
+	case strings.HasPrefix(r.URL.Path, "/tags/"):
+		s.serveTag(w, r, strings.TrimPrefix(r.URL.Path, "/tags/"))
+
+	case strings.HasPrefix(r.URL.Path, "/entries/"):
+		s.serveEntry(w, r, strings.TrimPrefix(r.URL.Path, "/entries/"))
+
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *MetaServer) serveTags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	tags, err := s.store.Tags()
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if tags == nil {
+		tags = []Tag{}
+	}
+
+	writeJSON(w, http.StatusOK, tags)
+}
+
+func (s *MetaServer) serveTag(w http.ResponseWriter, r *http.Request, name string) {
+	if name == "" {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		tag, err := s.store.FindTagByName(name)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if tag == nil {
+			writeError(w, http.StatusNotFound, "tag not found")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, tag)
+
+	case http.MethodPut:
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		var req publishRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestSize)).Decode(&req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+			return
+		}
+		if req.Id == uuid.Nil {
+			writeError(w, http.StatusBadRequest, "invalid request: missing Id")
+			return
+		}
+
+		_, exists, err := s.store.findEntry(req.Id)
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+		if exists {
+			writeError(w, http.StatusBadRequest, "entry exists already")
+			return
+		}
+
+		err = s.store.Publish(req.Id, req.BaseId, name, req.ExpectedHead)
+		if errors.Is(err, ErrTagConflict) {
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		}
+		if err != nil {
+			writeInternalError(w, r, err)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, Tag{Name: name, Id: req.Id})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (s *MetaServer) serveEntry(w http.ResponseWriter, r *http.Request, idStr string) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	id, err := uuid.Parse(idStr)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid entry id")
+		return
+	}
+
+	baseId, found, err := s.store.findEntry(id)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "entry not found")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, Entry{Id: id, BaseId: baseId})
+}
+
+func (s *MetaServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return false
+	}
+
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%v %v: %v", r.Method, r.URL.Path, err)
+	writeError(w, http.StatusInternalServerError, "internal error")
+}
@@ -2,6 +2,7 @@ package meta_hives
 
 import (
 	"database/sql"
+	"fmt"
 
 	_ "github.com/mattn/go-sqlite3"
 
@@ -12,21 +13,24 @@ type SqliteMetaHive struct {
 	db *sql.DB
 }
 
-func NewSqlite(fileName string) (*SqliteMetaHive, error) {
-	db, err := sql.Open("sqlite3", fileName)
-	if err != nil {
-		return nil, err
-	}
-
-	db.Exec("DROP TABLE tags; DROP TABLE entries;")
+// sqliteMigrations bring the schema from version i to i+1. The schema version is stored in
+// PRAGMA user_version. Never change a migration once released, append a new one instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS tags (name TEXT NOT NULL PRIMARY KEY, id TEXT NOT NULL);
+	CREATE TABLE IF NOT EXISTS entries (id TEXT NOT NULL PRIMARY KEY, base_id TEXT NOT NULL);`,
+}
 
-	_, err = db.Exec("CREATE TABLE tags (name TEXT NOT NULL PRIMARY KEY, id TEXT NOT NULL)")
+func NewSqlite(fileName string) (*SqliteMetaHive, error) {
+	// WAL and a busy timeout let several processes share the database. Transactions take the
+	// write lock right away so concurrent migrations don't deadlock.
+	db, err := sql.Open("sqlite3", fileName+"?_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate")
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = db.Exec("CREATE TABLE entries (id TEXT NOT NULL PRIMARY KEY, base_id TEXT NOT NULL)")
+	err = migrateSqlite(db)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
 
@@ -35,6 +39,39 @@ func NewSqlite(fileName string) (*SqliteMetaHive, error) {
 	}, nil
 }
 
+func migrateSqlite(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	err = tx.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+
+	for ; version < len(sqliteMigrations); version++ {
+		_, err = tx.Exec(sqliteMigrations[version])
+		if err != nil {
+			return fmt.Errorf("migration %d: %v", version+1, err)
+		}
+	}
+
+	// PRAGMA doesn't support parameters
+	_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func (p *SqliteMetaHive) Tags() ([]Tag, error) {
 	rows, err := p.db.Query("SELECT name, id FROM tags")
 	if err != nil {
@@ -46,7 +83,7 @@ func (p *SqliteMetaHive) Tags() ([]Tag, error) {
 	for rows.Next() {
 		var id uuid.UUID
 		var name string
-		err = rows.Scan(&id, &name)
+		err = rows.Scan(&name, &id)
 		if err != nil {
 			return nil, err
 		}
@@ -82,39 +119,52 @@ func (p *SqliteMetaHive) FindTagByName(name string) (*Tag, error) {
 	return nil, nil
 }
 
-func (p *SqliteMetaHive) UpdateTag(name string, newId uuid.UUID) error {
-	_, err := p.db.Exec("INSERT INTO tags (name, id) VALUES (?,?) ON CONFLICT(name) DO UPDATE SET id=excluded.id", &name, &newId)
+func (p *SqliteMetaHive) FindEntry(id uuid.UUID) (uuid.UUID, error) {
+	baseId, _, err := p.findEntry(id)
+	return baseId, err
+}
+
+// findEntry returns the base of the entry. Unlike FindEntry it tells unknown entries apart from
+// entries without base.
+func (p *SqliteMetaHive) findEntry(id uuid.UUID) (uuid.UUID, bool, error) {
+	var baseId uuid.UUID
+	err := p.db.QueryRow("SELECT base_id FROM entries WHERE id=?", &id).Scan(&baseId)
+	if err == sql.ErrNoRows {
+		return uuid.Nil, false, nil
+	}
 	if err != nil {
-		return err
+		return uuid.Nil, false, err
 	}
-	return nil
+	return baseId, true, nil
 }
 
-func (p *SqliteMetaHive) FindEntry(id uuid.UUID) (uuid.UUID, error) {
-	rows, err := p.db.Query("SELECT base_id FROM entries WHERE id=?", &id)
+func (p *SqliteMetaHive) Publish(entryId uuid.UUID, baseId uuid.UUID, tagName string, expectedHead uuid.UUID) error {
+	tx, err := p.db.Begin()
 	if err != nil {
-		return uuid.Nil, err
+		return err
 	}
-	defer rows.Close()
+	defer tx.Rollback()
 
-	if !rows.Next() {
-		return uuid.Nil, nil
+	head := uuid.Nil
+	err = tx.QueryRow("SELECT id FROM tags WHERE name=?", &tagName).Scan(&head)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if head != expectedHead {
+		return fmt.Errorf("%w: '%v' points at %v, expected %v", ErrTagConflict, tagName, head, expectedHead)
 	}
 
-	var base_id uuid.UUID
-	err = rows.Scan(&base_id)
+	_, err = tx.Exec("INSERT INTO entries (id, base_id) VALUES (?,?)", &entryId, &baseId)
 	if err != nil {
-		return uuid.Nil, err
+		return err
 	}
-	return base_id, nil
-}
 
-func (p *SqliteMetaHive) AddEntry(id uuid.UUID, baseId uuid.UUID) error {
-	_, err := p.db.Exec("INSERT INTO entries (id, base_id) VALUES (?,?)", &id, &baseId)
+	_, err = tx.Exec("INSERT INTO tags (name, id) VALUES (?,?) ON CONFLICT(name) DO UPDATE SET id=excluded.id", &tagName, &entryId)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	return tx.Commit()
 }
 
 func (p *SqliteMetaHive) Close() {
@@ -0,0 +1,144 @@
+package meta_hives
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSqlitePersistence(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+
+	hive, err := NewSqlite(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	versionID := uuid.New()
+	patchID := uuid.New()
+
+	if err := hive.Publish(versionID, uuid.Nil, "stable", uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := hive.Publish(patchID, versionID, "latest", uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+	hive.Close()
+
+	// Reopening must neither lose data nor fail migrating again
+	for i := 0; i < 2; i++ {
+		hive, err = NewSqlite(fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tags, err := hive.Tags()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tagIDs := make(map[string]uuid.UUID)
+		for _, tag := range tags {
+			tagIDs[tag.Name] = tag.Id
+		}
+		if len(tags) != 2 || tagIDs["stable"] != versionID || tagIDs["latest"] != patchID {
+			t.Errorf("unexpected tags %v", tags)
+		}
+
+		tag, err := hive.FindTagByName("latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tag == nil || tag.Id != patchID {
+			t.Errorf("unexpected tag %v", tag)
+		}
+
+		baseID, err := hive.FindEntry(patchID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if baseID != versionID {
+			t.Errorf("expected base %v, got %v", versionID, baseID)
+		}
+
+		hive.Close()
+	}
+}
+
+func TestSqlitePublishConflict(t *testing.T) {
+	hive, err := NewSqlite(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hive.Close()
+
+	versionID := uuid.New()
+	if err := hive.Publish(versionID, uuid.Nil, "latest", uuid.Nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two patches built on the same head, only the first one wins
+	patchID := uuid.New()
+	if err := hive.Publish(patchID, versionID, "latest", versionID); err != nil {
+		t.Fatal(err)
+	}
+
+	otherPatchID := uuid.New()
+	err = hive.Publish(otherPatchID, versionID, "latest", versionID)
+	if !errors.Is(err, ErrTagConflict) {
+		t.Fatalf("expected conflict, got %v", err)
+	}
+
+	tag, err := hive.FindTagByName("latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tag.Id != patchID {
+		t.Errorf("tag moved by failed publish")
+	}
+
+	baseID, err := hive.FindEntry(otherPatchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if baseID != uuid.Nil {
+		t.Errorf("entry added by failed publish")
+	}
+}
+
+func TestSqliteSchemaVersion(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+
+	hive, err := NewSqlite(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version int
+	if err := hive.db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		t.Fatal(err)
+	}
+	if version != len(sqliteMigrations) {
+		t.Errorf("expected schema version %v, got %v", len(sqliteMigrations), version)
+	}
+
+	var journalMode string
+	if err := hive.db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		t.Fatal(err)
+	}
+	if journalMode != "wal" {
+		t.Errorf("expected WAL journal mode, got %v", journalMode)
+	}
+
+	// Databases written by newer versions are refused
+	if _, err := hive.db.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+	hive.Close()
+
+	_, err = NewSqlite(fileName)
+	if err == nil {
+		t.Error("expected newer schema to be refused")
+	}
+}
@@ -1,64 +1,73 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
+	"io"
 
 	"github.com/google/uuid"
+
+	"github.com/OneManMonkeySquad/transport-cli/meta_hives"
 )
 
 type VersionPrevPatchProvider struct {
-	baseFile *PatchFile
+	id       uuid.UUID
+	base     *FlatPatch
+	dataHive DataHive
 }
 
-func NewVersionPatchProvider(baseFile *PatchFile) (*VersionPrevPatchProvider, error) {
+func NewVersionPatchProvider(id uuid.UUID, base *FlatPatch, dataHive DataHive) (*VersionPrevPatchProvider, error) {
 	return &VersionPrevPatchProvider{
-		baseFile: baseFile,
+		id:       id,
+		base:     base,
+		dataHive: dataHive,
 	}, nil
 }
 
 func (pp *VersionPrevPatchProvider) ID() uuid.UUID {
-	return pp.baseFile.ID
+	return pp.id
 }
 
 func (pp *VersionPrevPatchProvider) Changed() []BaseEntry {
-	return pp.baseFile.Changed
+	return pp.base.Entries
+}
+
+func (pp *VersionPrevPatchProvider) Content(entry BaseEntry, w io.Writer) error {
+	return downloadContent(pp.dataHive, entry.Blob(), w)
 }
 
-func patch(cfg *Config, tagName string, srcDir string) error {
-	baseFile, err := fetchBase(tagName, cfg.dataHive, cfg.metaHive)
+func patch(cfg *Config, tagName string, srcDir string, rules *ignoreRules) error {
+	tag, base, err := fetchBase(cfg, tagName)
 	if err != nil {
 		return err
 	}
 
-	pp, err := NewVersionPatchProvider(baseFile)
+	pp, err := NewVersionPatchProvider(tag.Id, base, cfg.dataHive)
 	if err != nil {
 		return err
 	}
 
-	return createStagedVersionOrPatch(cfg, srcDir, pp)
+	return createStagedVersionOrPatch(cfg, srcDir, pp, rules)
 }
 
-func fetchBase(tagName string, dataHive DataHive, metaHive MetaHive) (*PatchFile, error) {
-	tag, err := metaHive.FindTagByName(tagName)
+// fetchBase returns the file states of the latest published version/patch.
+func fetchBase(cfg *Config, tagName string) (*meta_hives.Tag, *FlatPatch, error) {
+	tag, err := cfg.metaHive.FindTagByName(tagName)
 	if err != nil {
-		return nil, fmt.Errorf("tag '%v' not found", tagName)
+		return nil, nil, err
 	}
-
-	entryContent, err := dataHive.DownloadFile(tag.Id.String() + ".json")
-	if err != nil {
-		return nil, err
+	if tag == nil {
+		return nil, nil, fmt.Errorf("tag '%v' not found", tagName)
 	}
 
-	var baseFile PatchFile
-	if err = json.Unmarshal(entryContent, &baseFile); err != nil {
-		return nil, err
+	restoreChain, err := findRestoreChain(cfg.metaHive, tag.Id)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if baseFile.Version != 1 {
-		return nil, errors.New("base file has wrong version")
+	base, err := flattenRestoreChain(cfg, restoreChain)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return &baseFile, nil
+	return tag, base, nil
 }
@@ -1,24 +1,106 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
-	"compress/zlib"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+// Written manifests have this version. Version 1 manifests store blobs as a compressed stream
+// split into fixed size chunks instead of content-defined chunks. Version 2 manifests only contain
+// regular files and no metadata.
+const patchFileVersion = 3
+
+// Entry types, regular files have none
+const (
+	entryTypeFile    = ""
+	entryTypeDir     = "dir"
+	entryTypeSymlink = "symlink"
+)
+
 type BaseEntry struct {
-	FileName         string
-	Hash             string
-	AdditionalChunks int `json:"AdditionalChunks,omitempty"`
+	FileName string
+	Type     string `json:"Type,omitempty"`
+	// Content hash and size of regular files
+	Hash string
+	Size int64 `json:"Size,omitempty"`
+	// Permission bits, 0 if unknown
+	Mode uint32 `json:"Mode,omitempty"`
+	// Target of symlinks
+	Target string `json:"Target,omitempty"`
+	// Modification time, only recorded with preserve_mtime
+	ModTime *time.Time `json:"ModTime,omitempty"`
+	// Hashes of the content-defined chunks the file consists of
+	Chunks           []string `json:"Chunks,omitempty"`
+	AdditionalChunks int      `json:"AdditionalChunks,omitempty"`
+	// Compression of the chunks: zstd, zlib or none. Empty means zlib.
+	Codec string `json:"Codec,omitempty"`
+	// Optional binary delta against the previous version of the file
+	Delta *DeltaEntry `json:"Delta,omitempty"`
+}
+
+type DeltaEntry struct {
+	// Hash of the file content the delta applies to
+	From             string
+	Chunks           []string `json:"Chunks,omitempty"`
+	AdditionalChunks int      `json:"AdditionalChunks,omitempty"`
+	Codec            string   `json:"Codec,omitempty"`
+}
+
+// blobRef describes where content is stored in the data hive.
+type blobRef struct {
+	// Content-defined chunks, addressed by the hash of their uncompressed content
+	chunks []string
+	// Version 1 manifests: compressed stream split into name, name_1, name_2, ...
+	name             string
+	additionalChunks int
+	codec            string
+}
+
+func (entry BaseEntry) Blob() blobRef {
+	return blobRef{
+		chunks:           entry.Chunks,
+		name:             entry.Hash,
+		additionalChunks: entry.AdditionalChunks,
+		codec:            entryCodec(entry.Codec),
+	}
+}
+
+func (entry BaseEntry) DeltaBlob() blobRef {
+	return blobRef{
+		chunks:           entry.Delta.Chunks,
+		name:             entry.Hash + "-" + entry.Delta.From,
+		additionalChunks: entry.Delta.AdditionalChunks,
+		codec:            entryCodec(entry.Delta.Codec),
+	}
+}
+
+// ChunkNames returns the names of all data hive files making up the blob.
+func (ref blobRef) ChunkNames() []string {
+	var names []string
+	if len(ref.chunks) > 0 {
+		for _, hash := range ref.chunks {
+			names = append(names, chunkBlobName(hash, ref.codec))
+		}
+	} else if ref.name != "" {
+		// Version 1 blob, directories and symlinks have neither
+		for i := 0; i < ref.additionalChunks+1; i++ {
+			names = append(names, chunkName(ref.name, i))
+		}
+	}
+	return names
 }
 
 type PatchFile struct {
@@ -28,6 +110,8 @@ type PatchFile struct {
 	// Contains new and changed files
 	Changed []BaseEntry
 	Deleted []DeletedEntry
+	// Ed25519 signature of the manifest without signature, added by commit
+	Signature []byte `json:"Signature,omitempty"`
 }
 
 type DeletedEntry struct {
@@ -37,13 +121,15 @@ type DeletedEntry struct {
 type PrevPatchProvider interface {
 	ID() uuid.UUID
 	Changed() []BaseEntry
+	// Content of a previous file, used as the base for deltas
+	Content(entry BaseEntry, w io.Writer) error
 }
 
-func createStagedVersionOrPatch(cfg *Config, srcDir string, pp PrevPatchProvider) error {
+func createStagedVersionOrPatch(cfg *Config, srcDir string, pp PrevPatchProvider, rules *ignoreRules) error {
 	os.RemoveAll(".staging")
 	os.Mkdir(".staging", 0777)
 
-	patch, err := createPatch(cfg, srcDir, pp)
+	patch, err := createPatch(cfg, srcDir, pp, rules)
 	if err != nil {
 		return err
 	}
@@ -51,55 +137,64 @@ func createStagedVersionOrPatch(cfg *Config, srcDir string, pp PrevPatchProvider
 	return writeToJsonFile(patch, ".staging/staged.json")
 }
 
-func createPatch(cfg *Config, srcDir string, pp PrevPatchProvider) (*PatchFile, error) {
+// patchScan holds the state of scanning the source directory.
+type patchScan struct {
+	cfg         *Config
+	pp          PrevPatchProvider
+	baseEntries map[string]BaseEntry
+	// Entries found in the source directory, ignored ones excluded
+	existingFileSet map[string]struct{}
+	knownChunks     map[string]struct{}
+	// Ignore rules of every scanned directory, by slash separated name
+	rulesByDir map[string]*ignoreRules
+	patch      *PatchFile
+}
+
+// createPatch compares srcDir to the previous version. Paths matched by rules are neither staged
+// nor deleted, they keep the state of the previous version.
+func createPatch(cfg *Config, srcDir string, pp PrevPatchProvider, rules *ignoreRules) (*PatchFile, error) {
 	patch := PatchFile{
-		Version: 1,
+		Version: patchFileVersion,
 		ID:      uuid.New(),
 		BaseID:  pp.ID(),
 	}
 
-	existingFileSet := make(map[string]struct{})
+	scan := patchScan{
+		cfg:             cfg,
+		pp:              pp,
+		baseEntries:     make(map[string]BaseEntry),
+		existingFileSet: make(map[string]struct{}),
+		knownChunks:     make(map[string]struct{}),
+		rulesByDir:      make(map[string]*ignoreRules),
+		patch:           &patch,
+	}
 
+	// Chunks referenced by the previous version are already in the data hive
 	for _, baseEntry := range pp.Changed() {
-		filePath := filepath.Join(srcDir, baseEntry.FileName)
-
-		stillExits, err := exists(filePath)
-		if err != nil {
-			return nil, err
-		}
-
-		if !stillExits {
-			var deleted DeletedEntry
-			deleted.FileName = baseEntry.FileName
-			patch.Deleted = append(patch.Deleted, deleted)
-			continue
-		}
-
-		existingFileSet[baseEntry.FileName] = struct{}{}
-
-		content, err := os.ReadFile(filePath)
-		if err != nil {
-			return nil, err
-		}
-
-		hash := sha256.Sum256(content)
-		hashStr := hex.EncodeToString(hash[:])
-
-		if hashStr != baseEntry.Hash {
-			changed, err := processPatchFile(cfg, hashStr, baseEntry.FileName, content)
-			if err != nil {
-				return nil, err
-			}
-
-			patch.Changed = append(patch.Changed, *changed)
+		for _, name := range baseEntry.Blob().ChunkNames() {
+			scan.knownChunks[name] = struct{}{}
 		}
+		scan.baseEntries[baseEntry.FileName] = baseEntry
 	}
 
-	err := processPatchDir(cfg, srcDir, "", existingFileSet, &patch)
+	if rules == nil {
+		rules = &ignoreRules{}
+	}
+	err := walkSource(srcDir, "", rules, scan.rulesByDir, scan.processEntry)
 	if err != nil {
 		return nil, err
 	}
 
+	for _, baseEntry := range pp.Changed() {
+		if _, ok := scan.existingFileSet[baseEntry.FileName]; ok {
+			continue
+		}
+		if ignoredInScan(scan.rulesByDir, baseEntry.FileName, baseEntry.Type == entryTypeDir) {
+			continue
+		}
+		patch.Deleted = append(patch.Deleted, DeletedEntry{FileName: baseEntry.FileName})
+	}
+
 	if len(patch.Changed) == 0 && len(patch.Deleted) == 0 {
 		return nil, errors.New("no changes")
 	}
@@ -107,88 +202,360 @@ func createPatch(cfg *Config, srcDir string, pp PrevPatchProvider) (*PatchFile,
 	return &patch, nil
 }
 
-func processPatchDir(cfg *Config, srcDir string, currentSubDir string, existingFileSet map[string]struct{}, patch *PatchFile) error {
+// walkSource calls fn for every directory, file and symlink below srcDir that isn't ignored,
+// directories before their content. Symlinks are not followed. The ignore rules of every directory
+// are put into rulesByDir, by slash separated name.
+func walkSource(srcDir string, currentSubDir string, rules *ignoreRules, rulesByDir map[string]*ignoreRules, fn func(fileName string, filePath string, info fs.FileInfo) error) error {
+	rules, err := rules.withIgnoreFile(srcDir, currentSubDir)
+	if err != nil {
+		return err
+	}
+	rulesByDir[filepath.ToSlash(currentSubDir)] = rules
+
 	files, err := os.ReadDir(srcDir)
 	if err != nil {
 		return err
 	}
 
 	for _, file := range files {
-		_, exists := existingFileSet[filepath.Join(currentSubDir, file.Name())]
-		if exists {
+		fileName := filepath.Join(currentSubDir, file.Name())
+		filePath := filepath.Join(srcDir, file.Name())
+
+		if rules.ignored(fileName, file.IsDir()) || (file.Name() == ignoreFileName && !file.IsDir()) {
+			continue
+		}
+		// Receipt of a restored directory
+		if currentSubDir == "" && file.Name() == receiptDirName {
 			continue
 		}
 
-		if file.IsDir() {
-			err := processPatchDir(cfg, filepath.Join(srcDir, file.Name()), filepath.Join(currentSubDir, file.Name()), existingFileSet, patch)
+		info, err := file.Info()
+		if err != nil {
+			return err
+		}
+
+		if err := fn(fileName, filePath, info); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			err := walkSource(filePath, fileName, rules, rulesByDir, fn)
 			if err != nil {
 				return err
 			}
-			continue
 		}
+	}
 
-		filePath := filepath.Join(srcDir, file.Name())
+	return nil
+}
+
+// scanEntry describes the file the way version and patch record it, without content. Returns nil
+// for file types that aren't supported. Files matching the receipt aren't hashed, receipt may be nil.
+func scanEntry(cfg *Config, fileName string, filePath string, info fs.FileInfo, receipt *InstallReceipt) (*BaseEntry, error) {
+	entry := BaseEntry{
+		FileName: fileName,
+		Mode:     uint32(info.Mode().Perm()),
+	}
+	if cfg.preserveMtime && info.Mode()&fs.ModeSymlink == 0 {
+		modTime := info.ModTime().Truncate(time.Second).UTC()
+		entry.ModTime = &modTime
+	}
 
-		content, err := os.ReadFile(filePath)
+	var err error
+	switch {
+	case info.IsDir():
+		entry.Type = entryTypeDir
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.Type = entryTypeSymlink
+		entry.Mode = 0
+		entry.Target, err = os.Readlink(filePath)
+		if err != nil {
+			return nil, err
+		}
+	case info.Mode().IsRegular():
+		entry.Size = info.Size()
+		entry.Hash, err = receipt.fileHash(filePath, fileName, info)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		fmt.Printf("%v: skipped, not a regular file\n", fileName)
+		return nil, nil
+	}
+
+	return &entry, nil
+}
+
+// processEntry adds the entry to the patch if it is new or changed.
+func (scan *patchScan) processEntry(fileName string, filePath string, info fs.FileInfo) error {
+	entry, err := scanEntry(scan.cfg, fileName, filePath, info, nil)
+	if err != nil || entry == nil {
+		return err
+	}
+
+	scan.existingFileSet[fileName] = struct{}{}
+
+	baseEntry, hasBase := scan.baseEntries[fileName]
+	if hasBase && baseEntry.Type != entry.Type {
+		// Switched between file, directory and symlink
+		hasBase = false
+	}
+
+	switch {
+	case hasBase && entry.Type == entryTypeFile && entry.Hash != baseEntry.Hash:
+		changed, err := processPatchFile(scan.cfg, *entry, filePath, scan.knownChunks, scan.pp, &baseEntry)
 		if err != nil {
 			return err
 		}
+		scan.patch.Changed = append(scan.patch.Changed, *changed)
+
+	case hasBase && entry.Type == entryTypeFile:
+		// Same content, the chunks are reused
+		if !sameMetadata(*entry, baseEntry) {
+			fmt.Printf("%v: metadata changed\n", fileName)
+			baseEntry.Size = entry.Size
+			baseEntry.Mode = entry.Mode
+			baseEntry.ModTime = entry.ModTime
+			baseEntry.Delta = nil
+			scan.patch.Changed = append(scan.patch.Changed, baseEntry)
+		}
 
-		hash := sha256.Sum256(content)
-		hashStr := hex.EncodeToString(hash[:])
+	case hasBase:
+		if !sameMetadata(*entry, baseEntry) {
+			scan.patch.Changed = append(scan.patch.Changed, *entry)
+		}
 
-		changed, err := processPatchFile(cfg, hashStr, filepath.Join(currentSubDir, file.Name()), content)
+	case entry.Type == entryTypeFile:
+		changed, err := processPatchFile(scan.cfg, *entry, filePath, scan.knownChunks, nil, nil)
 		if err != nil {
 			return err
 		}
+		scan.patch.Changed = append(scan.patch.Changed, *changed)
 
-		patch.Changed = append(patch.Changed, *changed)
+	default:
+		scan.patch.Changed = append(scan.patch.Changed, *entry)
 	}
 
 	return nil
 }
 
-func processPatchFile(cfg *Config, hashStr string, fileName string, content []byte) (*BaseEntry, error) {
-	compressedContent := new(bytes.Buffer)
-	{
-		zlibWriter := zlib.NewWriter(compressedContent)
-		defer zlibWriter.Close()
+// sameMetadata compares everything but the content.
+func sameMetadata(entry BaseEntry, other BaseEntry) bool {
+	if entry.Type != other.Type || entry.Mode != other.Mode || entry.Target != other.Target {
+		return false
+	}
+	if entry.ModTime == nil || other.ModTime == nil {
+		return entry.ModTime == nil && other.ModTime == nil
+	}
+	return entry.ModTime.Equal(*other.ModTime)
+}
 
-		_, err := zlibWriter.Write(content)
+// processPatchFile stages the content of the file entry. If baseEntry is given, a delta against it is staged too.
+func processPatchFile(cfg *Config, entry BaseEntry, filePath string, knownChunks map[string]struct{}, pp PrevPatchProvider, baseEntry *BaseEntry) (*BaseEntry, error) {
+	chunks, codec, compressedSize, err := stageFile(cfg, filePath, knownChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := entry
+	changed.Chunks = chunks
+	changed.Codec = codec
+
+	if baseEntry != nil && worthDelta(entry, *baseEntry) {
+		changed.Delta, err = processDelta(cfg, pp, *baseEntry, changed, filePath, compressedSize, knownChunks)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return &changed, nil
+}
+
+// worthDelta returns whether a delta of the file might pay off. Sizes of manifests before
+// version 3 aren't recorded and count as big enough.
+func worthDelta(entry BaseEntry, baseEntry BaseEntry) bool {
+	if entry.Size < deltaMinFileSize {
+		return false
+	}
+	return baseEntry.Size == 0 || baseEntry.Size >= deltaMinFileSize
+}
 
-		err = zlibWriter.Flush()
+// processDelta stages a delta from the previous version of the file. The full content is staged
+// anyway because restore falls back to it if the local file doesn't match the base.
+// Returns nil if the delta isn't worth it.
+func processDelta(cfg *Config, pp PrevPatchProvider, baseEntry BaseEntry, changed BaseEntry, filePath string, compressedSize int64, knownChunks map[string]struct{}) (*DeltaEntry, error) {
+	sig, err := baseSignature(pp, baseEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	deltaFile, err := os.Create(".staging/delta.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(".staging/delta.tmp")
+	defer deltaFile.Close()
+
+	{
+		file, err := os.Open(filePath)
 		if err != nil {
 			return nil, err
 		}
+		defer file.Close()
+
+		if err = createDelta(sig, file, deltaFile); err != nil {
+			return nil, err
+		}
 	}
 
-	numChunks := (compressedContent.Len() / cfg.ChunkSize()) + 1
-	if numChunks > 1024 {
-		return nil, errors.New("too many chunks")
+	if _, err = deltaFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	compressedDeltaSize, err := compressedSizeOf(cfg.codec, cfg.codecLevel, deltaFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep deltas that are considerably smaller than the full content
+	if compressedDeltaSize > compressedSize/2 {
+		return nil, nil
+	}
+
+	if _, err = deltaFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	chunks, codec, _, err := stageContent(cfg, deltaFile, knownChunks)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("%v: delta from %v\n", changed.FileName, baseEntry.Hash)
+	return &DeltaEntry{
+		From:   baseEntry.Hash,
+		Chunks: chunks,
+		Codec:  codec,
+	}, nil
+}
+
+// baseSignature downloads the previous version of a file into the staging directory and computes its delta signature.
+func baseSignature(pp PrevPatchProvider, baseEntry BaseEntry) (*deltaSignature, error) {
+	baseFile, err := os.Create(".staging/delta_base.tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(".staging/delta_base.tmp")
+	defer baseFile.Close()
+
+	if err = pp.Content(baseEntry, baseFile); err != nil {
+		return nil, err
 	}
 
-	for i := 0; i < numChunks; i++ {
-		name := ".staging/" + hashStr
-		if i > 0 {
-			name = fmt.Sprintf("%s_%d", name, i)
+	size, err := baseFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = baseFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return computeSignature(bufio.NewReader(baseFile), size)
+}
+
+func stageFile(cfg *Config, filePath string, knownChunks map[string]struct{}) ([]string, string, int64, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer file.Close()
+
+	return stageContent(cfg, file, knownChunks)
+}
+
+// stageContent splits content into content-defined chunks and writes the ones not already known
+// into the staging directory. Returns the chunk hashes, the codec and the total compressed size.
+// The manifest records one codec per file, so the first chunk decides it for all chunks: if
+// compressing it doesn't shrink it, f.i. for already compressed formats, no chunk is compressed.
+func stageContent(cfg *Config, content io.Reader, knownChunks map[string]struct{}) ([]string, string, int64, error) {
+	var chunks []string
+	codec := ""
+	var compressedSize int64
+
+	stageChunk := func(chunk []byte) error {
+		hash := sha256.Sum256(chunk)
+		hashStr := hex.EncodeToString(hash[:])
+		chunks = append(chunks, hashStr)
+
+		var compressedChunk *bytes.Buffer
+		if codec == "" {
+			var err error
+			compressedChunk, err = compress(cfg.codec, cfg.codecLevel, chunk)
+			if err != nil {
+				return err
+			}
+
+			codec = cfg.codec
+			if compressedChunk.Len() >= len(chunk) {
+				codec = codecNone
+				compressedChunk = bytes.NewBuffer(chunk)
+			}
+		} else {
+			var err error
+			compressedChunk, err = compress(codec, cfg.codecLevel, chunk)
+			if err != nil {
+				return err
+			}
 		}
+		compressedSize += int64(compressedChunk.Len())
 
-		chunk := compressedContent.Next(cfg.ChunkSize())
+		name := chunkBlobName(hashStr, codec)
+		if _, known := knownChunks[name]; known {
+			return nil
+		}
+		knownChunks[name] = struct{}{}
 
-		if err := os.WriteFile(name, chunk, 0666); err != nil {
-			return nil, err
+		return os.WriteFile(".staging/"+name, compressedChunk.Bytes(), 0666)
+	}
+
+	c := newChunker(content, cfg.ChunkSize())
+	defer c.Close()
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", 0, err
+		}
+
+		if err = stageChunk(chunk); err != nil {
+			return nil, "", 0, err
 		}
 	}
 
-	changed := BaseEntry{
-		FileName:         fileName,
-		Hash:             hashStr,
-		AdditionalChunks: numChunks - 1,
+	// Empty files still consist of one (empty) chunk
+	if len(chunks) == 0 {
+		if err := stageChunk(nil); err != nil {
+			return nil, "", 0, err
+		}
 	}
-	return &changed, nil
+
+	return chunks, codec, compressedSize, nil
+}
+
+// chunkBlobName returns the data hive file name of a content-defined chunk. The suffix names the
+// encoding of the stored chunk and keeps chunks apart from blobs of version 1 manifests.
+func chunkBlobName(hash string, codec string) string {
+	return hash + codecExtension(codec)
+}
+
+// chunkName returns the name of the i-th chunk of a version 1 blob.
+func chunkName(name string, i int) string {
+	if i == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s_%d", name, i)
 }
 
 func exists(name string) (bool, error) {
@@ -202,6 +569,21 @@ func exists(name string) (bool, error) {
 	return false, err
 }
 
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func writeToJsonFile(v interface{}, path string) error {
 	str, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
@@ -224,7 +606,7 @@ func readPatchFile(path string) PatchFile {
 			log.Fatal(err)
 		}
 
-		if patchFile.Version != 1 {
+		if patchFile.Version < 1 || patchFile.Version > patchFileVersion {
 			log.Fatal("Patch file has wrong version")
 		}
 	}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Restore leaves a receipt of the installed state in the restored directory. Files whose size and
+// modification time still match the receipt are trusted to be unchanged and not hashed again.
+
+const (
+	// Directory of the receipt in the restored directory, never part of versions or patches
+	receiptDirName = ".transport"
+	receiptVersion = 1
+)
+
+type InstallReceipt struct {
+	Version int
+	Tag     string
+	EntryID uuid.UUID
+	// When the receipt was written. Files modified at the same time or later are never trusted.
+	Time time.Time
+	// Flattened manifest of the installed entry
+	Entries []BaseEntry
+	// Files installed from the manifest, by file name. Protected files are missing.
+	Files map[string]InstalledFile
+
+	hashes map[string]string
+}
+
+type InstalledFile struct {
+	Size    int64
+	ModTime time.Time
+}
+
+func receiptPath(path string) string {
+	return filepath.Join(path, receiptDirName, "state.json")
+}
+
+// readReceipt returns the receipt of the directory, nil if there is none or it can't be used.
+func readReceipt(path string) *InstallReceipt {
+	content, err := os.ReadFile(receiptPath(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		fmt.Printf("Ignoring receipt: %v\n", err)
+		return nil
+	}
+
+	var receipt InstallReceipt
+	if err := json.Unmarshal(content, &receipt); err != nil {
+		fmt.Printf("Ignoring receipt: %v\n", err)
+		return nil
+	}
+	if receipt.Version != receiptVersion {
+		fmt.Printf("Ignoring receipt of version %v\n", receipt.Version)
+		return nil
+	}
+
+	receipt.hashes = make(map[string]string)
+	for _, entry := range receipt.Entries {
+		if entry.Type == entryTypeFile {
+			receipt.hashes[filepath.Clean(entry.FileName)] = entry.Hash
+		}
+	}
+	return &receipt
+}
+
+// writeReceipt writes the receipt into the restored tree at path. installed are the names of the
+// files written or kept as the manifest has them.
+func writeReceipt(path string, tagName string, entryID uuid.UUID, flatPatch *FlatPatch, installed []string) error {
+	receipt := InstallReceipt{
+		Version: receiptVersion,
+		Tag:     tagName,
+		EntryID: entryID,
+		Time:    time.Now(),
+		Entries: flatPatch.Entries,
+		Files:   make(map[string]InstalledFile),
+	}
+
+	for _, fileName := range installed {
+		info, err := os.Lstat(filepath.Join(path, fileName))
+		if err != nil {
+			return err
+		}
+		receipt.Files[fileName] = InstalledFile{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(path, receiptDirName), 0777); err != nil {
+		return err
+	}
+	return writeToJsonFile(receipt, receiptPath(path))
+}
+
+// fileHash returns the hash of a file of the installed directory. Files unchanged since the
+// receipt was written aren't read. receipt may be nil.
+func (receipt *InstallReceipt) fileHash(filePath string, fileName string, info fs.FileInfo) (string, error) {
+	if receipt != nil {
+		file, ok := receipt.Files[fileName]
+		hash, hasHash := receipt.hashes[filepath.Clean(fileName)]
+		if ok && hasHash && info.Size() == file.Size && info.ModTime().Equal(file.ModTime) && info.ModTime().Before(receipt.Time) {
+			return hash, nil
+		}
+	}
+
+	return hashFile(filePath)
+}
+
+// divergedFile returns the name of the first entry that isn't installed as the receipt says, empty
+// if there is none. Only metadata is compared, nothing is hashed.
+func (receipt *InstallReceipt) divergedFile(path string) string {
+	for _, entry := range receipt.Entries {
+		filePath := filepath.Join(path, entry.FileName)
+
+		info, err := os.Lstat(filePath)
+		if err != nil {
+			return entry.FileName
+		}
+
+		switch entry.Type {
+		case entryTypeDir:
+			if !info.IsDir() {
+				return entry.FileName
+			}
+
+		case entryTypeSymlink:
+			target, err := os.Readlink(filePath)
+			if err != nil || target != entry.Target {
+				return entry.FileName
+			}
+
+		default:
+			file, ok := receipt.Files[entry.FileName]
+			if !ok {
+				// Protected
+				continue
+			}
+			if !info.Mode().IsRegular() || info.Size() != file.Size || !info.ModTime().Equal(file.ModTime) || !info.ModTime().Before(receipt.Time) {
+				return entry.FileName
+			}
+		}
+	}
+	return ""
+}
+
+// receiptFromHashes finds the installed entry of a directory without receipt: the newest entry of
+// the restore chain whose files all match the directory, compared by hash. Returns a receipt for
+// it and its index, holding the hashes computed on the way so restore doesn't compute them again.
+// Returns nil if no entry matches.
+func receiptFromHashes(cfg *Config, path string, restoreChain []uuid.UUID, patchFiles []*PatchFile) (*InstallReceipt, int, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, -1, nil
+	}
+
+	receipt := &InstallReceipt{
+		Version: receiptVersion,
+		// Files modified while hashing aren't trusted
+		Time:   time.Now(),
+		Files:  make(map[string]InstalledFile),
+		hashes: make(map[string]string),
+	}
+
+	// Every file is hashed at most once, "" if it isn't a regular file
+	localHashes := make(map[string]string)
+	localHash := func(fileName string) (string, error) {
+		if hash, ok := localHashes[fileName]; ok {
+			return hash, nil
+		}
+
+		filePath := filepath.Join(path, fileName)
+		info, err := os.Lstat(filePath)
+		if err != nil || !info.Mode().IsRegular() {
+			localHashes[fileName] = ""
+			return "", nil
+		}
+
+		hash, err := hashFile(filePath)
+		if err != nil {
+			return "", err
+		}
+		localHashes[fileName] = hash
+		receipt.Files[fileName] = InstalledFile{
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		}
+		return hash, nil
+	}
+
+	for i := len(patchFiles) - 1; i >= 0; i-- {
+		flatPatch := flattenPatchFiles(nil, patchFiles[:i+1])
+		if err := validateEntries(flatPatch.Entries); err != nil {
+			return nil, -1, err
+		}
+
+		matches, err := installedMatch(cfg, path, flatPatch.Entries, localHash)
+		if err != nil {
+			return nil, -1, err
+		}
+		if !matches {
+			continue
+		}
+
+		receipt.EntryID = restoreChain[i]
+		receipt.Entries = flatPatch.Entries
+		for _, entry := range flatPatch.Entries {
+			if entry.Type == entryTypeFile {
+				receipt.hashes[filepath.Clean(entry.FileName)] = entry.Hash
+			}
+		}
+		return receipt, i, nil
+	}
+	return nil, -1, nil
+}
+
+// installedMatch returns whether the directory has all entries. Files restore doesn't know about
+// and protected paths are ignored, so is metadata.
+func installedMatch(cfg *Config, path string, entries []BaseEntry, localHash func(fileName string) (string, error)) (bool, error) {
+	for _, entry := range entries {
+		if cfg.protected.ignoredPath(entry.FileName, entry.Type == entryTypeDir) {
+			continue
+		}
+		filePath := filepath.Join(path, entry.FileName)
+
+		switch entry.Type {
+		case entryTypeDir:
+			info, err := os.Lstat(filePath)
+			if err != nil || !info.IsDir() {
+				return false, nil
+			}
+
+		case entryTypeSymlink:
+			target, err := os.Readlink(filePath)
+			if err != nil || target != entry.Target {
+				return false, nil
+			}
+
+		default:
+			hash, err := localHash(entry.FileName)
+			if err != nil {
+				return false, err
+			}
+			if hash != entry.Hash {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
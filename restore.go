@@ -2,15 +2,18 @@ package main
 
 import (
 	"bytes"
-	"compress/zlib"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -20,80 +23,580 @@ type FlatPatch struct {
 	Deleted []DeletedEntry
 }
 
-func restore(cfg *Config, tagName string, path string) error {
+type restoreOptions struct {
+	// Remove everything not in the manifest, except protected paths
+	clean bool
+}
+
+func restore(cfg *Config, tagName string, path string, options restoreOptions) error {
 	fmt.Printf("Restoring '%s'...\n", tagName)
 
-	head, err := cfg.metaHive.FindTagByName(tagName)
+	restoreChain, err := findTagRestoreChain(cfg, tagName)
 	if err != nil {
 		return err
 	}
-	if head == nil {
-		return errors.New("tag not found")
-	}
 
-	restoreChain, err := findRestoreChain(cfg.metaHive, head.Id)
+	path, err = filepath.Abs(path)
 	if err != nil {
 		return err
 	}
 
+	if err := recoverSwap(path); err != nil {
+		return err
+	}
+
 	// Now, instead of just going through patches, we collapse them into one.
 	// This way we don't write a single file multiple times or write and then delete a file.
-	flatPatch, err := flattenRestoreChain(restoreChain, cfg.dataHive)
+	// If the directory is still at the entry of its receipt, only the patches after it are needed.
+	receipt := readReceipt(path)
+	flatPatch, err := flattenFromReceipt(cfg, restoreChain, path, receipt)
 	if err != nil {
 		return err
 	}
+	if flatPatch == nil {
+		flatPatch, receipt, err = flattenFromHashes(cfg, restoreChain, path, receipt)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The new tree is built next to the target and only swapped in once complete and verified.
+	// A failed restore leaves the target untouched.
+	stagingPath := restoreStagingPath(path)
+	os.RemoveAll(stagingPath)
 
-	err = os.MkdirAll(path, 0777)
+	installed, err := stageRestore(cfg, flatPatch, path, stagingPath, options, receipt)
+	if err == nil {
+		err = writeReceipt(stagingPath, tagName, restoreChain[len(restoreChain)-1], flatPatch, installed)
+	}
 	if err != nil {
+		os.RemoveAll(stagingPath)
 		return err
 	}
 
+	return swapInRestore(path, stagingPath)
+}
+
+// findTagRestoreChain returns the restore chain of the tag's head. Offline, the chain seen by
+// the last online restore is used.
+func findTagRestoreChain(cfg *Config, tagName string) ([]uuid.UUID, error) {
+	if cfg.offline {
+		return cfg.cache.RestoreChain(tagName)
+	}
+
+	head, err := cfg.metaHive.FindTagByName(tagName)
+	if err != nil {
+		return nil, err
+	}
+	if head == nil {
+		return nil, errors.New("tag not found")
+	}
+
+	restoreChain, err := findRestoreChain(cfg.metaHive, head.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.cache != nil {
+		if err = cfg.cache.RememberRestoreChain(tagName, restoreChain); err != nil {
+			return nil, err
+		}
+	}
+
+	return restoreChain, nil
+}
+
+// Sibling directories of the restore target
+func restoreStagingPath(path string) string {
+	return path + ".transport-staging"
+}
+
+func restorePrevPath(path string) string {
+	return path + ".transport-prev"
+}
+
+func rollbackTmpPath(path string) string {
+	return path + ".transport-rollback"
+}
+
+// stageRestore builds the restored tree in stagingPath. Unchanged and untracked files of the
+// current tree are hard-linked (or copied) instead of written. Existing protected paths are
+// carried over as they are, even if the manifest has them. Files of the current tree matching the
+// receipt aren't hashed. Returns the names of the files installed as the manifest has them.
+func stageRestore(cfg *Config, flatPatch *FlatPatch, path string, stagingPath string, options restoreOptions, receipt *InstallReceipt) ([]string, error) {
+	err := validateEntries(flatPatch.Entries)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(stagingPath, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]BaseEntry)
 	for _, entry := range flatPatch.Entries {
+		entries[filepath.Clean(entry.FileName)] = entry
+	}
+	deleted := make(map[string]struct{})
+	for _, entry := range flatPatch.Deleted {
+		deleted[filepath.Clean(entry.FileName)] = struct{}{}
+	}
+
+	// Keep everything restore doesn't know about
+	err = carryOverUntracked(path, stagingPath, entries, deleted, cfg.protected, options.clean)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find out what to do with each entry
+	const (
+		actionKeep = iota
+		actionCopy
+		actionDelta
+		actionWrite
+		actionDir
+		actionSymlink
+		actionProtected
+	)
+	actions := make([]int, len(flatPatch.Entries))
+	err = forEachParallel(cfg.parallelism, len(flatPatch.Entries), func(i int) error {
+		entry := flatPatch.Entries[i]
+
+		if cfg.protected.ignoredPath(entry.FileName, entry.Type == entryTypeDir) {
+			if _, err := os.Lstat(filepath.Join(path, entry.FileName)); err == nil {
+				actions[i] = actionProtected
+				return nil
+			}
+		}
+
+		switch entry.Type {
+		case entryTypeDir:
+			actions[i] = actionDir
+			return nil
+		case entryTypeSymlink:
+			actions[i] = actionSymlink
+			return nil
+		}
+
 		filePath := filepath.Join(path, entry.FileName)
 
-		hashStr := ""
-		{
-			existingContent, err := os.ReadFile(filePath)
-			if err == nil {
-				hash := sha256.Sum256(existingContent)
-				hashStr = hex.EncodeToString(hash[:])
+		var hashStr string
+		info, err := os.Lstat(filePath)
+		if err == nil && info.Mode().IsRegular() {
+			hashStr, _ = receipt.fileHash(filePath, entry.FileName, info)
+		}
+
+		if hashStr == entry.Hash {
+			// A hard link shares the metadata with the previous tree, which must not change
+			actions[i] = actionKeep
+			if !metadataMatches(entry, info) {
+				actions[i] = actionCopy
 			}
+		} else if entry.Delta != nil && hashStr == entry.Delta.From {
+			actions[i] = actionDelta
+		} else {
+			actions[i] = actionWrite
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-		if hashStr != entry.Hash {
-			err = write(entry, filePath, cfg.dataHive)
-			if err != nil {
+	// Download everything needed into the cache up front, in parallel
+	var blobs []blobRef
+	for i, entry := range flatPatch.Entries {
+		switch actions[i] {
+		case actionDelta:
+			blobs = append(blobs, entry.DeltaBlob())
+		case actionWrite:
+			blobs = append(blobs, entry.Blob())
+		}
+	}
+
+	backend, cleanup, err := prefetch(cfg, blobs)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	err = forEachParallel(cfg.parallelism, len(flatPatch.Entries), func(i int) error {
+		entry := flatPatch.Entries[i]
+		filePath := filepath.Join(path, entry.FileName)
+		stagedPath := filepath.Join(stagingPath, entry.FileName)
+
+		switch actions[i] {
+		case actionProtected:
+			// Carried over already
+			return nil
+
+		case actionKeep:
+			return linkOrCopy(filePath, stagedPath)
+
+		case actionCopy:
+			if err := copyFile(filePath, stagedPath); err != nil {
+				return err
+			}
+			return applyMetadata(entry, stagedPath)
+
+		case actionDir:
+			// Mode and modification time are set once the content is complete
+			return os.MkdirAll(stagedPath, 0777)
+
+		case actionSymlink:
+			if err := os.MkdirAll(filepath.Dir(stagedPath), 0777); err != nil {
 				return err
 			}
+			return os.Symlink(entry.Target, stagedPath)
+
+		case actionDelta:
+			err := writeDelta(entry, filePath, stagedPath, backend)
+			if err == nil {
+				return applyMetadata(entry, stagedPath)
+			}
+			fmt.Printf("%v: applying delta failed, falling back to full download (%v)\n", filePath, err)
+		}
+
+		if err := write(entry, stagedPath, backend); err != nil {
+			return err
+		}
+		return applyMetadata(entry, stagedPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Children first, so creating them doesn't touch the modification time of a finished directory
+	var dirs []BaseEntry
+	for i, entry := range flatPatch.Entries {
+		if actions[i] == actionDir {
+			dirs = append(dirs, entry)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return dirs[i].FileName > dirs[j].FileName
+	})
+	for _, entry := range dirs {
+		if err := applyMetadata(entry, filepath.Join(stagingPath, entry.FileName)); err != nil {
+			return nil, err
+		}
+	}
+
+	var installed []string
+	for i, entry := range flatPatch.Entries {
+		if entry.Type == entryTypeFile && actions[i] != actionProtected {
+			installed = append(installed, entry.FileName)
+		}
+	}
+	return installed, nil
+}
+
+// validateEntries makes sure no entry is written outside of the restore target, either by its
+// name or through a symlink of the manifest.
+func validateEntries(entries []BaseEntry) error {
+	symlinks := make(map[string]struct{})
+	for _, entry := range entries {
+		if entry.Type == entryTypeSymlink {
+			symlinks[filepath.Clean(entry.FileName)] = struct{}{}
+		}
+	}
+
+	for _, entry := range entries {
+		fileName := filepath.Clean(entry.FileName)
+		if filepath.IsAbs(fileName) || fileName == "." || fileName == ".." || strings.HasPrefix(fileName, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name '%v' in manifest", entry.FileName)
+		}
+		if fileName == receiptDirName || strings.HasPrefix(fileName, receiptDirName+string(filepath.Separator)) {
+			return fmt.Errorf("invalid file name '%v' in manifest, reserved for the receipt", entry.FileName)
+		}
+
+		for dir := filepath.Dir(fileName); dir != "."; dir = filepath.Dir(dir) {
+			if _, ok := symlinks[dir]; ok {
+				return fmt.Errorf("invalid file name '%v' in manifest, '%v' is a symlink", entry.FileName, dir)
+			}
 		}
 	}
-	for _, entry := range flatPatch.Deleted {
-		filePath := filepath.Join(path, entry.FileName)
-		os.Remove(filePath)
+	return nil
+}
+
+// metadataMatches returns whether the file has the mode and modification time of the entry.
+// Entries without metadata match any file.
+func metadataMatches(entry BaseEntry, info fs.FileInfo) bool {
+	if entry.Mode != 0 && uint32(info.Mode().Perm()) != entry.Mode {
+		return false
+	}
+	if entry.ModTime != nil && !info.ModTime().Truncate(time.Second).Equal(*entry.ModTime) {
+		return false
 	}
+	return true
+}
 
+func applyMetadata(entry BaseEntry, filePath string) error {
+	if entry.Mode != 0 {
+		if err := os.Chmod(filePath, fs.FileMode(entry.Mode)); err != nil {
+			return err
+		}
+	}
+	if entry.ModTime != nil {
+		if err := os.Chtimes(filePath, *entry.ModTime, *entry.ModTime); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func write(entry BaseEntry, filePath string, backend DataHive) error {
-	var compressedContent = new(bytes.Buffer)
+// prefetch downloads all chunks of the blobs into the cache, pinned until cleanup. Without
+// cache there's nothing to do, the chunks are downloaded while the files are written, so a
+// restore doesn't need the disk space twice. Returns the data hive to read the blobs from.
+func prefetch(cfg *Config, blobs []blobRef) (DataHive, func(), error) {
+	if cfg.cache == nil {
+		return cfg.dataHive, func() {}, nil
+	}
+
+	nameSet := make(map[string]struct{})
+	var names []string
+	for _, blob := range blobs {
+		for _, name := range blob.ChunkNames() {
+			if _, ok := nameSet[name]; !ok {
+				nameSet[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+	}
+
+	cfg.cache.Pin(names)
+	cleanup := func() {
+		if err := cfg.cache.Unpin(); err != nil {
+			fmt.Printf("Shrinking the cache failed: %v\n", err)
+		}
+	}
+
+	downloadProgress := newProgress("Downloading", len(names))
+	err := forEachParallel(cfg.parallelism, len(names), func(i int) error {
+		downloadProgress.Step(names[i])
+		if err := cfg.dataHive.DownloadFile(names[i], io.Discard); err != nil {
+			return fmt.Errorf("download %v: %v", names[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
 
-	for i := 0; i < entry.AdditionalChunks+1; i++ {
-		name := entry.Hash
-		if i > 0 {
-			name = fmt.Sprintf("%s_%d", name, i)
+	return cfg.dataHive, cleanup, nil
+}
+
+// carryOverUntracked links the files of the current tree restore doesn't know about into the
+// staging directory. With clean, only protected paths are carried over.
+func carryOverUntracked(path string, stagingPath string, entries map[string]BaseEntry, deleted map[string]struct{}, protected *ignoreRules, clean bool) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return filepath.WalkDir(path, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
 		}
 
-		newContent, err := backend.DownloadFile(name)
+		rel, err := filepath.Rel(path, filePath)
 		if err != nil {
 			return err
 		}
+		if rel == "." {
+			return nil
+		}
+		if rel == receiptDirName {
+			// Written anew
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		stagedPath := filepath.Join(stagingPath, rel)
+
+		entry, isEntry := entries[rel]
+		_, isDeleted := deleted[rel]
+
+		if protected.ignoredPath(rel, d.IsDir()) {
+			if d.IsDir() {
+				return os.MkdirAll(stagedPath, 0777)
+			}
+			return carryOver(filePath, stagedPath, d)
+		}
+
+		if d.IsDir() {
+			if isEntry && entry.Type != entryTypeDir {
+				fmt.Printf("%v: replaced by a %v, untracked files in it are dropped\n", filePath, entryTypeName(entry.Type))
+				return filepath.SkipDir
+			}
+			// Tracked directories are created by their entry, others only if files in them remain.
+			// Empty ones are kept unless cleaning.
+			if isEntry || isDeleted || clean {
+				return nil
+			}
+			return os.MkdirAll(stagedPath, 0777)
+		}
+
+		if isEntry || isDeleted {
+			return nil
+		}
+
+		if clean {
+			fmt.Printf("%v: removed, not part of the manifest\n", filePath)
+			return nil
+		}
+
+		return carryOver(filePath, stagedPath, d)
+	})
+}
+
+// carryOver links the file or recreates the symlink.
+func carryOver(filePath string, stagedPath string, d fs.DirEntry) error {
+	if d.Type()&fs.ModeSymlink != 0 {
+		if err := os.MkdirAll(filepath.Dir(stagedPath), 0777); err != nil {
+			return err
+		}
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, stagedPath)
+	}
+
+	return linkOrCopy(filePath, stagedPath)
+}
+
+func entryTypeName(entryType string) string {
+	if entryType == entryTypeFile {
+		return "file"
+	}
+	return entryType
+}
+
+// linkOrCopy hard-links the file if possible. Restore never modifies files in place, so the
+// previous tree is not affected by linking.
+func linkOrCopy(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
 
-		if _, err = compressedContent.Write(newContent); err != nil {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	return copyFile(src, dst)
+}
+
+func copyFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {
+		return err
+	}
+
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	info, err := srcFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Close()
+}
+
+var errExchangeUnsupported = errors.New("atomic exchange not supported")
+
+// swapInRestore replaces the target with the staged tree. The previous tree is kept for rollback.
+// Where the OS can't exchange both atomically, a crash between the two renames leaves the target
+// missing, recoverSwap repairs that.
+func swapInRestore(path string, stagingPath string) error {
+	prevPath := restorePrevPath(path)
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return os.Rename(stagingPath, path)
+	}
+
+	err := exchangePaths(stagingPath, path)
+	if err == nil {
+		// The staging path holds the previous tree now
+		if err := os.RemoveAll(prevPath); err != nil {
 			return err
 		}
+		return os.Rename(stagingPath, prevPath)
+	}
+	if !errors.Is(err, errExchangeUnsupported) {
+		return err
+	}
+
+	if err := os.RemoveAll(prevPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, prevPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(stagingPath, path); err != nil {
+		if rollbackErr := os.Rename(prevPath, path); rollbackErr != nil {
+			return fmt.Errorf("swap in %v: %v (moving back previous version failed: %v)", path, err, rollbackErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// recoverSwap repairs the directory after a restore or rollback was interrupted between two
+// renames. If the directory is missing, the newest complete tree is moved back: a staged tree
+// that already has its receipt, the tree being rolled back or the previous tree.
+func recoverSwap(path string) error {
+	prevPath := restorePrevPath(path)
+	rollbackPath := rollbackTmpPath(path)
+
+	if _, err := os.Lstat(path); err == nil {
+		// Rollback was interrupted after the previous tree was moved in
+		if _, err := os.Lstat(prevPath); errors.Is(err, os.ErrNotExist) {
+			if _, err := os.Lstat(rollbackPath); err == nil {
+				return os.Rename(rollbackPath, prevPath)
+			}
+		}
+		return nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	var candidates []string
+	stagingPath := restoreStagingPath(path)
+	if _, err := os.Stat(receiptPath(stagingPath)); err == nil {
+		candidates = append(candidates, stagingPath)
 	}
+	candidates = append(candidates, rollbackPath, prevPath)
+
+	for _, candidate := range candidates {
+		if _, err := os.Lstat(candidate); err != nil {
+			continue
+		}
+
+		fmt.Printf("Recovering '%v' from '%v' after an interrupted swap\n", path, candidate)
+		return os.Rename(candidate, path)
+	}
+	return nil
+}
 
+func write(entry BaseEntry, filePath string, backend DataHive) error {
 	// Create directory
 	dirName := filepath.Dir(filePath)
 	if _, err := os.Stat(dirName); err != nil {
@@ -102,7 +605,8 @@ func write(entry BaseEntry, filePath string, backend DataHive) error {
 		}
 	}
 
-	// Write file
+	// Write file, hashing it on the way
+	hash := sha256.New()
 	{
 		file, err := os.Create(filePath)
 		if err != nil {
@@ -110,37 +614,125 @@ func write(entry BaseEntry, filePath string, backend DataHive) error {
 		}
 		defer file.Close()
 
-		zlibReader, err := zlib.NewReader(compressedContent)
+		if err = downloadContent(backend, entry.Blob(), io.MultiWriter(file, hash)); err != nil {
+			return fmt.Errorf("download %v: %v", filePath, err)
+		}
+	}
+
+	err := verify(entry, filePath, hex.EncodeToString(hash.Sum(nil)))
+	if err != nil && len(entry.Chunks) == 0 {
+		// Version 1 blobs have no chunk hashes, the next restore downloads them again
+		evictCorrupt(backend, entry.Blob().ChunkNames()...)
+	}
+	return err
+}
+
+// writeDelta applies the delta to basePath, which has to match entry.Delta.From, and writes the result to filePath.
+func writeDelta(entry BaseEntry, basePath string, filePath string, backend DataHive) error {
+	if err := os.MkdirAll(filepath.Dir(filePath), 0777); err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	{
+		base, err := os.Open(basePath)
 		if err != nil {
 			return err
 		}
-		defer zlibReader.Close()
+		defer base.Close()
 
-		_, err = io.Copy(file, zlibReader)
-		if err != nil && err != io.ErrUnexpectedEOF { // Why UnexpEOF? Satan knows
-			return fmt.Errorf("decompress %v: %v", filePath, err)
+		file, err := os.Create(filePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// The delta is applied while it is downloaded
+		deltaReader, deltaWriter := io.Pipe()
+		go func() {
+			deltaWriter.CloseWithError(downloadContent(backend, entry.DeltaBlob(), deltaWriter))
+		}()
+
+		err = applyDelta(base, deltaReader, io.MultiWriter(file, hash))
+		deltaReader.CloseWithError(err)
+		if err != nil {
+			return fmt.Errorf("apply delta %v: %v", filePath, err)
 		}
 	}
 
-	// Verify
-	{
-		hashStr := ""
-		{
-			existingContent, err := os.ReadFile(filePath)
-			if err == nil {
-				hash := sha256.Sum256(existingContent)
-				hashStr = hex.EncodeToString(hash[:])
+	return verify(entry, filePath, hex.EncodeToString(hash.Sum(nil)))
+}
+
+func verify(entry BaseEntry, filePath string, hashStr string) error {
+	if hashStr != entry.Hash {
+		fmt.Println(hashStr, " ", entry.Hash)
+		return fmt.Errorf("restore %v: consistency violation - checksum different after restore", filePath)
+	}
+
+	fmt.Println(filePath, "Hash OK")
+	return nil
+}
+
+// downloadContent downloads and decompresses a blob into w. At most one chunk is held in memory.
+// Chunks are checked against their hash, corrupt ones are evicted from the cache and downloaded
+// again.
+func downloadContent(backend DataHive, ref blobRef, w io.Writer) error {
+	if len(ref.chunks) > 0 {
+		compressedChunk := new(bytes.Buffer)
+		chunk := new(bytes.Buffer)
+		for i, name := range ref.ChunkNames() {
+			err := downloadChunk(backend, ref.codec, name, ref.chunks[i], compressedChunk, chunk)
+			if errors.Is(err, errCorruptContent) && evictCorrupt(backend, name) {
+				err = downloadChunk(backend, ref.codec, name, ref.chunks[i], compressedChunk, chunk)
+			}
+			if err != nil {
+				return err
+			}
+
+			if _, err := w.Write(chunk.Bytes()); err != nil {
+				return err
 			}
 		}
+		return nil
+	}
 
-		if hashStr != entry.Hash {
-			fmt.Println(hashStr, " ", entry.Hash)
-			return fmt.Errorf("restore %v: consistency violation - checksum different after restore", filePath)
+	// Version 1 blobs are a single compressed stream, decompressed while the chunks are downloaded
+	compressedReader, compressedWriter := io.Pipe()
+	go func() {
+		for _, name := range ref.ChunkNames() {
+			if err := backend.DownloadFile(name, compressedWriter); err != nil {
+				compressedWriter.CloseWithError(err)
+				return
+			}
 		}
+		compressedWriter.Close()
+	}()
+
+	err := decompress(ref.codec, w, compressedReader)
+	compressedReader.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("decompress %v: %v", ref.name, err)
+	}
+	return nil
+}
+
+// downloadChunk downloads and decompresses one chunk into chunk and checks it against hash.
+func downloadChunk(backend DataHive, codec string, name string, hash string, compressedChunk *bytes.Buffer, chunk *bytes.Buffer) error {
+	compressedChunk.Reset()
+	chunk.Reset()
 
-		fmt.Println(filePath, "Hash OK")
+	if err := backend.DownloadFile(name, compressedChunk); err != nil {
+		return err
+	}
+
+	if err := decompress(codec, chunk, compressedChunk); err != nil {
+		return fmt.Errorf("%w: decompress %v: %v", errCorruptContent, name, err)
 	}
 
+	chunkHash := sha256.Sum256(chunk.Bytes())
+	if hex.EncodeToString(chunkHash[:]) != hash {
+		return fmt.Errorf("%w: %v doesn't match its hash", errCorruptContent, name)
+	}
 	return nil
 }
 
@@ -169,35 +761,111 @@ func findRestoreChain(metaHive MetaHive, head uuid.UUID) ([]uuid.UUID, error) {
 	return restoreChain, nil
 }
 
-func flattenRestoreChain(restoreChain []uuid.UUID, persistence DataHive) (*FlatPatch, error) {
-	entryMap := make(map[string]BaseEntry)
-	deletedMap := make(map[string]DeletedEntry)
+func flattenRestoreChain(cfg *Config, restoreChain []uuid.UUID) (*FlatPatch, error) {
+	patchFiles, err := downloadPatchFiles(cfg, restoreChain)
+	if err != nil {
+		return nil, err
+	}
 
-	for i, entry := range restoreChain {
-		patchContent, err := persistence.DownloadFile(entry.String() + ".json")
-		if err != nil {
-			return nil, err
+	return flattenPatchFiles(nil, patchFiles), nil
+}
+
+// flattenFromReceipt flattens the patches after the installed entry on top of the flattened
+// manifest of the receipt. Returns nil if the installed entry isn't part of the restore chain
+// (anymore) or the directory diverged from the receipt.
+func flattenFromReceipt(cfg *Config, restoreChain []uuid.UUID, path string, receipt *InstallReceipt) (*FlatPatch, error) {
+	if receipt == nil {
+		return nil, nil
+	}
+
+	installed := -1
+	for i, id := range restoreChain {
+		if id == receipt.EntryID {
+			installed = i
 		}
+	}
+	if installed < 0 {
+		fmt.Printf("Installed entry %v is not part of the restore chain, restoring from its start\n", receipt.EntryID)
+		return nil, nil
+	}
 
-		var patchFile PatchFile
-		err = json.Unmarshal(patchContent, &patchFile)
+	if fileName := receipt.divergedFile(path); fileName != "" {
+		fmt.Printf("%v differs from the receipt, restoring from the start of the restore chain\n", fileName)
+		return nil, nil
+	}
+
+	patchFiles, err := downloadPatchFilesAfter(cfg, receipt.EntryID, restoreChain[installed+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Installed entry %v found, applying %d of %d patches\n", receipt.EntryID, len(patchFiles), len(restoreChain))
+	return flattenPatchFiles(receipt.Entries, patchFiles), nil
+}
+
+// flattenFromHashes flattens the whole restore chain. Without receipt, the installed entry is
+// found by comparing hashes, the returned receipt holds the hashes computed on the way so only
+// files changed after it are touched.
+func flattenFromHashes(cfg *Config, restoreChain []uuid.UUID, path string, receipt *InstallReceipt) (*FlatPatch, *InstallReceipt, error) {
+	patchFiles, err := downloadPatchFiles(cfg, restoreChain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if receipt == nil {
+		found, installed, err := receiptFromHashes(cfg, path, restoreChain, patchFiles)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
+		}
+		if found != nil {
+			// Flattened from the start anyway, files deleted before the installed entry but
+			// still there are removed too
+			flatPatch := flattenPatchFiles(nil, patchFiles)
+			fmt.Printf("Installed entry %v found by hashes, %d files changed in the %d patches since\n", found.EntryID, changedEntries(found.Entries, flatPatch), len(restoreChain)-installed-1)
+			return flatPatch, found, nil
 		}
+	}
 
-		if i == 0 {
-			for _, entry := range patchFile.Changed {
-				entryMap[entry.FileName] = entry
-			}
-		} else {
-			for _, entry := range patchFile.Changed {
-				entryMap[entry.FileName] = entry
-				delete(deletedMap, entry.FileName)
-			}
-			for _, entry := range patchFile.Deleted {
-				delete(entryMap, entry.FileName)
-				deletedMap[entry.FileName] = entry
-			}
+	return flattenPatchFiles(nil, patchFiles), receipt, nil
+}
+
+// changedEntries returns the number of entries added, changed or deleted by flatPatch compared to
+// the installed entries.
+func changedEntries(installed []BaseEntry, flatPatch *FlatPatch) int {
+	installedMap := make(map[string]BaseEntry)
+	for _, entry := range installed {
+		installedMap[entry.FileName] = entry
+	}
+
+	changed := 0
+	for _, entry := range flatPatch.Entries {
+		old, ok := installedMap[entry.FileName]
+		if !ok || old.Type != entry.Type || old.Hash != entry.Hash || old.Target != entry.Target {
+			changed++
+		}
+		delete(installedMap, entry.FileName)
+	}
+	return changed + len(installedMap)
+}
+
+// flattenPatchFiles applies the patches in order on top of the base entries.
+func flattenPatchFiles(base []BaseEntry, patchFiles []*PatchFile) *FlatPatch {
+	entryMap := make(map[string]BaseEntry)
+	deletedMap := make(map[string]DeletedEntry)
+
+	for _, entry := range base {
+		entryMap[entry.FileName] = entry
+	}
+
+	// Versions have no deletions, snapshots keep the deletions of the patches they replace
+	for _, patchFile := range patchFiles {
+		for _, entry := range patchFile.Changed {
+			entryMap[entry.FileName] = entry
+			delete(deletedMap, entry.FileName)
+		}
+		for _, entry := range patchFile.Deleted {
+			delete(entryMap, entry.FileName)
+			deletedMap[entry.FileName] = entry
 		}
 	}
 
@@ -213,5 +881,57 @@ func flattenRestoreChain(restoreChain []uuid.UUID, persistence DataHive) (*FlatP
 		result.Deleted = append(result.Deleted, entry)
 	}
 
-	return &result, nil
+	return &result
+}
+
+// downloadPatchFiles downloads the manifests of all entries, keeping their order.
+// With a public key configured, every manifest must be signed and form a chain with the one before.
+func downloadPatchFiles(cfg *Config, entries []uuid.UUID) ([]*PatchFile, error) {
+	return downloadPatchFilesAfter(cfg, uuid.Nil, entries)
+}
+
+// downloadPatchFilesAfter downloads the manifests of entries, the first of them is based on baseID.
+func downloadPatchFilesAfter(cfg *Config, baseID uuid.UUID, entries []uuid.UUID) ([]*PatchFile, error) {
+	patchFiles := make([]*PatchFile, len(entries))
+
+	err := forEachParallel(cfg.parallelism, len(entries), func(i int) error {
+		patchContent := new(bytes.Buffer)
+		err := cfg.dataHive.DownloadFile(entries[i].String()+".json", patchContent)
+		if err != nil {
+			return err
+		}
+
+		var patchFile PatchFile
+		err = json.Unmarshal(patchContent.Bytes(), &patchFile)
+		if err != nil {
+			return err
+		}
+
+		if patchFile.Version < 1 || patchFile.Version > patchFileVersion {
+			return errors.New("patch file has wrong version")
+		}
+
+		if cfg.publicKey != nil {
+			if err := verifyPatchFile(&patchFile, cfg.publicKey); err != nil {
+				return err
+			}
+
+			// A valid manifest stored under a different name or out of order is an attack too
+			expectedBaseID := baseID
+			if i > 0 {
+				expectedBaseID = entries[i-1]
+			}
+			if patchFile.ID != entries[i] || patchFile.BaseID != expectedBaseID {
+				return fmt.Errorf("manifest %v doesn't belong to entry %v", patchFile.ID, entries[i])
+			}
+		}
+
+		patchFiles[i] = &patchFile
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return patchFiles, nil
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// rollback swaps the directory with the tree it had before the last restore.
+// Rolling back twice restores the newer tree again.
+func rollback(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	if err := recoverSwap(path); err != nil {
+		return err
+	}
+
+	prevPath := restorePrevPath(path)
+	if _, err := os.Stat(prevPath); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("no previous version of '%v'", path)
+	}
+
+	err = exchangePaths(path, prevPath)
+	if errors.Is(err, errExchangeUnsupported) {
+		err = swapByRenames(path, prevPath)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Rolled back '%s'\n", path)
+	return nil
+}
+
+// swapByRenames swaps the directory and its previous tree through a temporary path. A crash in
+// between is repaired by recoverSwap.
+func swapByRenames(path string, prevPath string) error {
+	tmpPath := rollbackTmpPath(path)
+	if err := os.RemoveAll(tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(path, tmpPath); err != nil {
+		return err
+	}
+
+	if err := os.Rename(prevPath, path); err != nil {
+		os.Rename(tmpPath, path)
+		return err
+	}
+
+	return os.Rename(tmpPath, prevPath)
+}
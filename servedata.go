@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/OneManMonkeySquad/transport-cli/data_hives"
+)
+
+// serveData serves a local data hive directory for data_hive = "http".
+func serveData(path string, address string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", path)
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           data_hives.NewDataServer(path, os.Stdout),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	fmt.Printf("Serving data hive '%v' on %v\n", path, address)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/OneManMonkeySquad/transport-cli/meta_hives"
+)
+
+// serveMeta serves a sqlite meta hive over HTTP for meta_hive = "server".
+func serveMeta(fileName string, address string, token string) error {
+	store, err := meta_hives.NewSqlite(fileName)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if token == "" {
+		fmt.Println("No token set, serving read-only")
+	}
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           meta_hives.NewMetaServer(store, token),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	fmt.Printf("Serving meta hive '%v' on %v\n", fileName, address)
+	return server.ListenAndServe()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Manifests are signed with Ed25519. The signature covers the JSON encoding of the manifest
+// without signature. Manifests reference chunks by the hash of their content and restore checks
+// the hash of every written file, so a valid manifest protects the blobs too.
+
+// keygen writes a new private key to keyPath and prints the public key for release.toml.
+func keygen(keyPath string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(keyPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(base64.StdEncoding.EncodeToString(privateKey) + "\n")
+	if err != nil {
+		return err
+	}
+
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Private key written to '%v', keep it secret.\n", keyPath)
+	fmt.Printf("Add the public key to release.toml and production.toml:\npublic_key = \"%v\"\n", base64.StdEncoding.EncodeToString(publicKey))
+	return nil
+}
+
+func parsePrivateKey(str string) (ed25519.PrivateKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key: %v", err)
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid signing key: wrong size")
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+func parsePublicKey(str string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key: wrong size")
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func signedContent(patchFile PatchFile) ([]byte, error) {
+	patchFile.Signature = nil
+	return json.Marshal(patchFile)
+}
+
+func signPatchFile(patchFile *PatchFile, key ed25519.PrivateKey) error {
+	content, err := signedContent(*patchFile)
+	if err != nil {
+		return err
+	}
+
+	patchFile.Signature = ed25519.Sign(key, content)
+	return nil
+}
+
+func verifyPatchFile(patchFile *PatchFile, key ed25519.PublicKey) error {
+	if len(patchFile.Signature) == 0 {
+		return fmt.Errorf("manifest %v is not signed", patchFile.ID)
+	}
+
+	content, err := signedContent(*patchFile)
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, content, patchFile.Signature) {
+		return fmt.Errorf("manifest %v has an invalid signature", patchFile.ID)
+	}
+	return nil
+}
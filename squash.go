@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// squash publishes the flattened state of the tag as a new snapshot entry without base and moves
+// the tag to it. Restores of the tag then only need a single manifest. No chunks are uploaded,
+// the snapshot references the chunks of the squashed entries.
+func squash(cfg *Config, tagName string) error {
+	tag, base, err := fetchBase(cfg, tagName)
+	if err != nil {
+		return err
+	}
+
+	snapshot := PatchFile{
+		Version: patchFileVersion,
+		ID:      uuid.New(),
+		BaseID:  uuid.Nil,
+		Changed: base.Entries,
+		// Deletions are kept so restores still remove files deleted by the squashed patches
+		Deleted: base.Deleted,
+	}
+	sort.Slice(snapshot.Changed, func(i, j int) bool {
+		return snapshot.Changed[i].FileName < snapshot.Changed[j].FileName
+	})
+	sort.Slice(snapshot.Deleted, func(i, j int) bool {
+		return snapshot.Deleted[i].FileName < snapshot.Deleted[j].FileName
+	})
+
+	if cfg.signingKey != nil {
+		if err := signPatchFile(&snapshot, cfg.signingKey); err != nil {
+			return err
+		}
+	}
+
+	content, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.dataHive.UploadFile(snapshot.ID.String()+".json", bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+
+	err = cfg.metaHive.Publish(snapshot.ID, snapshot.BaseID, tagName, tag.Id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Squashed '%v' (%v) into snapshot %v\n", tagName, tag.Id, snapshot.ID)
+	return nil
+}
+
+// autoSquash squashes the tag once its restore chain holds squashEvery patches on top of the
+// first version or snapshot.
+func autoSquash(cfg *Config, tagName string, head uuid.UUID) error {
+	if cfg.squashEvery <= 0 {
+		return nil
+	}
+
+	restoreChain, err := findRestoreChain(cfg.metaHive, head)
+	if err != nil {
+		return err
+	}
+
+	if len(restoreChain)-1 < cfg.squashEvery {
+		return nil
+	}
+
+	return squash(cfg, tagName)
+}
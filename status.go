@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Differences between a directory and a tag
+const (
+	// In the directory, unknown to the tag
+	statusAdded = "added"
+	// Content, type or metadata differs
+	statusModified = "modified"
+	// In the tag, not in the directory
+	statusMissing = "missing"
+	// In the directory, but deleted by the tag
+	statusExtra = "extra"
+)
+
+type StatusReport struct {
+	Tag     string
+	EntryID uuid.UUID
+	Dirty   bool
+	Files   []StatusFile
+}
+
+type StatusFile struct {
+	FileName string
+	Status   string
+	// Size of the local file, 0 if missing
+	Size int64 `json:"Size,omitempty"`
+	// Size of the file in the tag, 0 if not recorded
+	ExpectedSize int64 `json:"ExpectedSize,omitempty"`
+}
+
+// status compares the directory to the tag and prints the differences, as JSON with asJSON.
+// Ignored and protected paths are left out, files matching the receipt aren't hashed.
+// Returns whether the directory differs.
+func status(cfg *Config, tagName string, path string, asJSON bool) (bool, error) {
+	report, err := compareToTag(cfg, tagName, path)
+	if err != nil {
+		return false, err
+	}
+
+	if asJSON {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return false, err
+		}
+		fmt.Println(string(content))
+		return report.Dirty, nil
+	}
+
+	for _, file := range report.Files {
+		switch {
+		case file.Status == statusMissing && file.ExpectedSize > 0:
+			fmt.Printf("%-9s %v (%d bytes expected)\n", file.Status, file.FileName, file.ExpectedSize)
+		case file.Status == statusMissing:
+			fmt.Printf("%-9s %v\n", file.Status, file.FileName)
+		case file.Status == statusModified && file.ExpectedSize > 0:
+			fmt.Printf("%-9s %v (%d bytes, %d expected)\n", file.Status, file.FileName, file.Size, file.ExpectedSize)
+		default:
+			fmt.Printf("%-9s %v (%d bytes)\n", file.Status, file.FileName, file.Size)
+		}
+	}
+
+	if report.Dirty {
+		fmt.Printf("'%v' differs from '%v' (%v) in %d files\n", path, tagName, report.EntryID, len(report.Files))
+	} else {
+		fmt.Printf("'%v' matches '%v' (%v)\n", path, tagName, report.EntryID)
+	}
+	return report.Dirty, nil
+}
+
+func compareToTag(cfg *Config, tagName string, path string) (*StatusReport, error) {
+	restoreChain, err := findTagRestoreChain(cfg, tagName)
+	if err != nil {
+		return nil, err
+	}
+
+	flatPatch, err := flattenRestoreChain(cfg, restoreChain)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]BaseEntry)
+	for _, entry := range flatPatch.Entries {
+		entries[filepath.Clean(entry.FileName)] = entry
+	}
+	deleted := make(map[string]struct{})
+	for _, entry := range flatPatch.Deleted {
+		deleted[filepath.Clean(entry.FileName)] = struct{}{}
+	}
+	// Manifests before version 3 have no directory entries
+	parents := make(map[string]struct{})
+	for fileName := range entries {
+		for dir := filepath.Dir(fileName); dir != "."; dir = filepath.Dir(dir) {
+			parents[dir] = struct{}{}
+		}
+	}
+
+	report := &StatusReport{
+		Tag:     tagName,
+		EntryID: restoreChain[len(restoreChain)-1],
+	}
+	receipt := readReceipt(path)
+	found := make(map[string]struct{})
+	rulesByDir := make(map[string]*ignoreRules)
+
+	err = walkSource(path, "", &ignoreRules{}, rulesByDir, func(fileName string, filePath string, info fs.FileInfo) error {
+		if cfg.protected.ignoredPath(fileName, info.IsDir()) {
+			return nil
+		}
+
+		local, err := scanEntry(cfg, fileName, filePath, info, receipt)
+		if err != nil || local == nil {
+			return err
+		}
+		found[fileName] = struct{}{}
+
+		entry, ok := entries[fileName]
+		if _, isParent := parents[fileName]; !ok && isParent && local.Type == entryTypeDir {
+			return nil
+		}
+		if !ok {
+			fileStatus := statusAdded
+			if _, ok := deleted[fileName]; ok {
+				fileStatus = statusExtra
+			}
+			report.Files = append(report.Files, StatusFile{FileName: fileName, Status: fileStatus, Size: local.Size})
+			return nil
+		}
+
+		if local.Type != entry.Type || local.Hash != entry.Hash || local.Target != entry.Target || !metadataMatches(entry, info) {
+			report.Files = append(report.Files, StatusFile{FileName: fileName, Status: statusModified, Size: local.Size, ExpectedSize: entry.Size})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for fileName, entry := range entries {
+		if _, ok := found[fileName]; ok {
+			continue
+		}
+		isDir := entry.Type == entryTypeDir
+		if ignoredInScan(rulesByDir, fileName, isDir) || cfg.protected.ignoredPath(fileName, isDir) {
+			continue
+		}
+		report.Files = append(report.Files, StatusFile{FileName: fileName, Status: statusMissing, ExpectedSize: entry.Size})
+	}
+
+	sort.Slice(report.Files, func(i, j int) bool {
+		return report.Files[i].FileName < report.Files[j].FileName
+	})
+	report.Dirty = len(report.Files) > 0
+	return report, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+
+	"github.com/OneManMonkeySquad/transport-cli/meta_hives"
+)
+
+// blobCheck is a blob referenced by the verified tags.
+type blobCheck struct {
+	ref blobRef
+	// Hash of the content, empty for deltas
+	hash string
+	// Tags, entries and files referencing the blob
+	affects map[string]struct{}
+}
+
+// hiveProblem is a missing or corrupt object of the data hive.
+type hiveProblem struct {
+	name    string
+	problem string
+	affects map[string]struct{}
+}
+
+type verifyReport struct {
+	mutex    sync.Mutex
+	problems map[string]*hiveProblem
+}
+
+func (r *verifyReport) add(name string, problem string, affects map[string]struct{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	p, ok := r.problems[name]
+	if !ok {
+		p = &hiveProblem{name: name, problem: problem, affects: make(map[string]struct{})}
+		r.problems[name] = p
+	}
+	for affected := range affects {
+		p.affects[affected] = struct{}{}
+	}
+}
+
+// verifyHive checks that every manifest and blob of the restore chain of the tag (or of all tags)
+// is intact: chunks are downloaded, decompressed and checked against their hash, file contents
+// against BaseEntry.Hash. quick only checks that the chunks exist. Prints a report of all missing
+// and corrupt objects and fails if there are any.
+func verifyHive(cfg *Config, tagName string, all bool, quick bool) error {
+	var tags []meta_hives.Tag
+	if all {
+		var err error
+		tags, err = cfg.metaHive.Tags()
+		if err != nil {
+			return err
+		}
+	} else {
+		tag, err := cfg.metaHive.FindTagByName(tagName)
+		if err != nil {
+			return err
+		}
+		if tag == nil {
+			return fmt.Errorf("tag '%v' not found", tagName)
+		}
+		tags = append(tags, *tag)
+	}
+
+	report := &verifyReport{problems: make(map[string]*hiveProblem)}
+	blobs := make(map[string]*blobCheck)
+	var blobNames []string
+	addBlob := func(ref blobRef, hash string, affected string) {
+		key := strings.Join(ref.ChunkNames(), ",")
+		if key == "" {
+			return
+		}
+
+		blob, ok := blobs[key]
+		if !ok {
+			blob = &blobCheck{ref: ref, hash: hash, affects: make(map[string]struct{})}
+			blobs[key] = blob
+			blobNames = append(blobNames, key)
+		}
+		blob.affects[affected] = struct{}{}
+	}
+
+	numManifests := 0
+	for _, tag := range tags {
+		restoreChain, err := findRestoreChain(cfg.metaHive, tag.Id)
+		if err != nil {
+			return fmt.Errorf("tag '%v': %v", tag.Name, err)
+		}
+
+		for i, entryID := range restoreChain {
+			numManifests++
+			affected := fmt.Sprintf("tag '%v', entry %v", tag.Name, entryID)
+
+			baseID := uuid.Nil
+			if i > 0 {
+				baseID = restoreChain[i-1]
+			}
+			patchFiles, err := downloadPatchFilesAfter(cfg, baseID, restoreChain[i:i+1])
+			if err != nil {
+				report.add(entryID.String()+".json", problemOf(err), map[string]struct{}{affected: {}})
+				continue
+			}
+
+			for _, entry := range patchFiles[0].Changed {
+				fileAffected := fmt.Sprintf("%v, file %v", affected, entry.FileName)
+				addBlob(entry.Blob(), entry.Hash, fileAffected)
+				if entry.Delta != nil {
+					addBlob(entry.DeltaBlob(), "", fileAffected+" (delta)")
+				}
+			}
+		}
+	}
+
+	sort.Strings(blobNames)
+	progress := newProgress("Verifying", len(blobNames))
+	err := forEachParallel(cfg.parallelism, len(blobNames), func(i int) error {
+		blob := blobs[blobNames[i]]
+		progress.Step(blob.ref.ChunkNames()[0])
+
+		name, problem := checkBlob(cfg.dataHive, blob.ref, blob.hash, quick)
+		if problem != "" {
+			report.add(name, problem, blob.affects)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(report.problems))
+	for name := range report.problems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := report.problems[name]
+		fmt.Printf("%v: %v\n", p.name, p.problem)
+
+		affects := make([]string, 0, len(p.affects))
+		for affected := range p.affects {
+			affects = append(affects, affected)
+		}
+		sort.Strings(affects)
+		for _, affected := range affects {
+			fmt.Printf("    affects %v\n", affected)
+		}
+	}
+
+	fmt.Printf("Verified %d tags, %d manifests and %d blobs, %d problems\n", len(tags), numManifests, len(blobNames), len(names))
+	if len(names) > 0 {
+		return errors.New("verification failed")
+	}
+	return nil
+}
+
+// checkBlob checks one blob. Returns the name of the broken object and the problem, the problem
+// is empty if the blob is intact.
+func checkBlob(backend DataHive, ref blobRef, hash string, quick bool) (string, string) {
+	// Version 1 blobs must not have more chunks than recorded
+	if len(ref.chunks) == 0 {
+		nextName := chunkName(ref.name, ref.additionalChunks+1)
+		if _, err := backend.Stat(nextName); err == nil {
+			return ref.name, fmt.Sprintf("corrupt, more chunks than the %d recorded", ref.additionalChunks+1)
+		}
+	}
+
+	if quick {
+		for _, name := range ref.ChunkNames() {
+			if _, err := backend.Stat(name); err != nil {
+				return name, problemOf(err)
+			}
+		}
+		return "", ""
+	}
+
+	contentHash := sha256.New()
+
+	if len(ref.chunks) > 0 {
+		compressedChunk := new(bytes.Buffer)
+		chunk := new(bytes.Buffer)
+		for i, name := range ref.ChunkNames() {
+			compressedChunk.Reset()
+			if err := backend.DownloadFile(name, compressedChunk); err != nil {
+				return name, problemOf(err)
+			}
+
+			chunk.Reset()
+			if err := decompress(ref.codec, chunk, compressedChunk); err != nil {
+				return name, fmt.Sprintf("corrupt, decompression failed: %v", err)
+			}
+
+			chunkHash := sha256.Sum256(chunk.Bytes())
+			if hex.EncodeToString(chunkHash[:]) != ref.chunks[i] {
+				return name, "corrupt, content doesn't match the chunk hash"
+			}
+
+			contentHash.Write(chunk.Bytes())
+		}
+	} else {
+		for _, name := range ref.ChunkNames() {
+			if _, err := backend.Stat(name); err != nil {
+				return name, problemOf(err)
+			}
+		}
+
+		if err := downloadContent(backend, ref, contentHash); err != nil {
+			return ref.name, fmt.Sprintf("corrupt, %v", err)
+		}
+	}
+
+	if hash != "" && hex.EncodeToString(contentHash.Sum(nil)) != hash {
+		return strings.Join(ref.ChunkNames(), ", "), "corrupt, content doesn't match the file hash"
+	}
+	return "", ""
+}
+
+func problemOf(err error) string {
+	if errors.Is(err, os.ErrNotExist) {
+		return "missing"
+	}
+	return fmt.Sprintf("unreadable, %v", err)
+}
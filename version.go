@@ -1,6 +1,11 @@
 package main
 
-import "github.com/google/uuid"
+import (
+	"errors"
+	"io"
+
+	"github.com/google/uuid"
+)
 
 type NullPrevPatchProvider struct {
 }
@@ -13,7 +18,11 @@ func (pp *NullPrevPatchProvider) Changed() []BaseEntry {
 	return []BaseEntry{}
 }
 
-func version(cfg *Config, srcDir string) error {
+func (pp *NullPrevPatchProvider) Content(entry BaseEntry, w io.Writer) error {
+	return errors.New("no previous version")
+}
+
+func version(cfg *Config, srcDir string, rules *ignoreRules) error {
 	pp := &NullPrevPatchProvider{}
-	return createStagedVersionOrPatch(cfg, srcDir, pp)
+	return createStagedVersionOrPatch(cfg, srcDir, pp, rules)
 }
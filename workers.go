@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// forEachParallel calls fn for every index in [0, count) on up to parallelism goroutines.
+// No new calls are started after the first error, which is returned.
+func forEachParallel(parallelism int, count int, fn func(i int) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var firstErr error
+	next := 0
+
+	worker := func() {
+		defer wg.Done()
+
+		for {
+			mutex.Lock()
+			if firstErr != nil || next >= count {
+				mutex.Unlock()
+				return
+			}
+			i := next
+			next++
+			mutex.Unlock()
+
+			if err := fn(i); err != nil {
+				mutex.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mutex.Unlock()
+			}
+		}
+	}
+
+	for w := 0; w < parallelism && w < count; w++ {
+		wg.Add(1)
+		go worker()
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// progress prints numbered progress lines from multiple workers.
+type progress struct {
+	mutex sync.Mutex
+	verb  string
+	done  int
+	total int
+}
+
+func newProgress(verb string, total int) *progress {
+	return &progress{
+		verb:  verb,
+		total: total,
+	}
+}
+
+func (p *progress) Step(name string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.done++
+	fmt.Printf("[%d/%d] %s %s ...\n", p.done, p.total, p.verb, name)
+}
+
+func (p *progress) Skip(name string, reason string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.done++
+	fmt.Printf("[%d/%d] Skipping %s, %s\n", p.done, p.total, name, reason)
+}